@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gesquive/cli"
+	"github.com/gesquive/templr/daemon"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ctlCmd represents the ctl command
+var ctlCmd = &cobra.Command{
+	Use:   "ctl [reload|status|hosts|hash|pause|resume]",
+	Short: "Control a running templr daemon",
+	Long: `Talk to a running templr daemon through its control socket.
+
+  reload  load the template again and apply it
+  status  show the last render and apply, and the last error
+  hosts   list the resolved hosts and their addresses
+  hash    show the hash of the applied rules
+  pause   stop applying DNS and template changes automatically
+  resume  apply automatically again, including any held back changes`,
+	ValidArgs: []string{"reload", "status", "hosts", "hash", "pause", "resume"},
+	Args:      cobra.ExactArgs(1),
+	Run:       runCtl,
+}
+
+func init() {
+	RootCmd.AddCommand(ctlCmd)
+}
+
+func runCtl(cmd *cobra.Command, args []string) {
+	command := args[0]
+	request := command
+	if command == "hash" {
+		request = daemon.CommandStatus
+	}
+
+	response, err := daemon.SendCommand(viper.GetString("socket"), request)
+	if err != nil {
+		cli.Error("%v", err)
+		os.Exit(3)
+	}
+	if !response.OK {
+		cli.Error("%s", response.Error)
+		os.Exit(10)
+	}
+
+	switch command {
+	case "hosts":
+		printHosts(response)
+	case "hash":
+		cli.Info(response.Status.RulesHash)
+	default:
+		printDaemonStatus(response.Status)
+	}
+}
+
+func printDaemonStatus(status *daemon.Status) {
+	if status == nil {
+		return
+	}
+	state := "running"
+	if status.Paused {
+		state = "paused"
+	}
+	if status.Pending {
+		state += ", changes pending"
+	}
+	if status.Drifted {
+		state += ", live rules drifted"
+	}
+	cli.Info("State:       %s", state)
+	cli.Info("Rules hash:  %s", status.RulesHash)
+	cli.Info("Rendered at: %s", formatTime(status.RenderedAt))
+	cli.Info("Applied at:  %s", formatTime(status.AppliedAt))
+	if len(status.LastError) > 0 {
+		cli.Info("Last error:  %s (%s)", status.LastError, formatTime(status.ErrorAt))
+	}
+}
+
+func printHosts(response *daemon.Response) {
+	for _, host := range response.Hosts {
+		addrs := strings.Join(host.Addrs, ", ")
+		if len(host.Error) > 0 {
+			addrs = fmt.Sprintf("error: %s", host.Error)
+		}
+		expires := "never expires"
+		if !host.Static {
+			expires = fmt.Sprintf("expires %s", formatTime(host.Expires))
+		}
+		cli.Info("%s: %s (%s)", host.Host, addrs, expires)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006/01/02 15:04:05 -0700")
+}
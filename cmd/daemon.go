@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gesquive/cli"
+	"github.com/gesquive/templr/daemon"
+	"github.com/gesquive/templr/iptables"
+	"github.com/gesquive/templr/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Keep the firewall up to date with DNS",
+	Long: `Bring up the firewall, then look up the hosts used in the rules again as
+their DNS records expire and reload the rules whenever an address changes.
+With --watch, changes to the template files are tested and loaded as well.
+
+A SIGHUP loads the template again. When started by systemd, the daemon
+reports its state and answers the watchdog.`,
+	Run: runDaemon,
+}
+
+func init() {
+	RootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().Duration("min-refresh", daemon.DefaultMinRefresh,
+		"The shortest time to wait between DNS refreshes")
+	daemonCmd.Flags().Duration("max-refresh", daemon.DefaultMaxRefresh,
+		"The longest time to wait between DNS refreshes")
+	daemonCmd.Flags().BoolP("watch", "w", false,
+		"Reload the rules when the template or its imports change")
+	daemonCmd.Flags().Duration("debounce", daemon.DefaultDebounce,
+		"How long template changes have to settle before they are loaded")
+	daemonCmd.Flags().String("metrics-listen", "",
+		"Serve prometheus metrics on this address, like localhost:9732")
+	daemonCmd.Flags().Duration("verify-interval", daemon.DefaultVerifyInterval,
+		"How often to check the live rules for drift, 0 turns the check off")
+	daemonCmd.Flags().Bool("auto-correct", false,
+		"Apply the rules again when the live rules drift")
+
+	viper.BindEnv("min-refresh")
+	viper.BindEnv("max-refresh")
+	viper.BindEnv("watch")
+	viper.BindEnv("debounce")
+	viper.BindEnv("metrics-listen")
+	viper.BindEnv("verify-interval")
+	viper.BindEnv("auto-correct")
+
+	viper.BindPFlag("min-refresh", daemonCmd.Flags().Lookup("min-refresh"))
+	viper.BindPFlag("max-refresh", daemonCmd.Flags().Lookup("max-refresh"))
+	viper.BindPFlag("watch", daemonCmd.Flags().Lookup("watch"))
+	viper.BindPFlag("debounce", daemonCmd.Flags().Lookup("debounce"))
+	viper.BindPFlag("metrics-listen", daemonCmd.Flags().Lookup("metrics-listen"))
+	viper.BindPFlag("verify-interval", daemonCmd.Flags().Lookup("verify-interval"))
+	viper.BindPFlag("auto-correct", daemonCmd.Flags().Lookup("auto-correct"))
+}
+
+func runDaemon(cmd *cobra.Command, args []string) {
+	requireFirewall()
+
+	rulePath := viper.GetString("rules")
+	if len(rulePath) == 0 {
+		cli.Error("No rules specified")
+		os.Exit(2)
+	}
+
+	if viper.GetBool("auto-correct") && !managed {
+		// every chain docker, kubernetes or fail2ban adds would count as drift
+		cli.Error("Auto correct needs managed chains, turn on --managed-chains")
+		os.Exit(2)
+	}
+
+	var verify daemon.VerifyFunc
+	if viper.GetDuration("verify-interval") > 0 {
+		verify = verifyRules
+	}
+
+	d := daemon.New(daemon.Config{
+		RulesPath:      rulePath,
+		AppVersion:     displayVersion,
+		Options:        rulesetOptions(),
+		MinRefresh:     viper.GetDuration("min-refresh"),
+		MaxRefresh:     viper.GetDuration("max-refresh"),
+		Apply:          applyRules,
+		Validate:       validateRules,
+		Watch:          viper.GetBool("watch"),
+		Debounce:       viper.GetDuration("debounce"),
+		SocketPath:     viper.GetString("socket"),
+		MetricsAddr:    viper.GetString("metrics-listen"),
+		Families:       enabledFamilies(),
+		LiveRules:      liveRules,
+		Verify:         verify,
+		VerifyInterval: viper.GetDuration("verify-interval"),
+		AutoCorrect:    viper.GetBool("auto-correct"),
+		Locked: func() bool {
+			return state.Panicked(viper.GetString("state-dir"))
+		},
+	})
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				log.Infof("Received %s, reloading", sig)
+				if err := d.Reload(); err != nil {
+					log.Debugf("reload: %v", err)
+				}
+				continue
+			}
+			log.Infof("Received %s, shutting down", sig)
+			close(stop)
+			return
+		}
+	}()
+
+	log.Info("Starting templr daemon")
+	if err := d.Run(stop); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(10)
+	}
+}
+
+// enabledFamilies returns the ip families the command applies to
+func enabledFamilies() []iptables.Family {
+	families := []iptables.Family{}
+	if runIPv4 {
+		families = append(families, iptables.IPv4)
+	}
+	if runIPv6 {
+		families = append(families, iptables.IPv6)
+	}
+	return families
+}
+
+// liveRules returns the live rules of the enabled ip families
+func liveRules() (map[iptables.Family]*iptables.Rules, error) {
+	live := make(map[iptables.Family]*iptables.Rules)
+	if runIPv4 {
+		rules, err := iptables.GetIPv4Rules()
+		if err != nil {
+			return live, err
+		}
+		live[iptables.IPv4] = rules
+	}
+	if runIPv6 {
+		rules, err := iptables.GetIPv6Rules()
+		if err != nil {
+			return live, err
+		}
+		live[iptables.IPv6] = rules
+	}
+	return live, nil
+}
@@ -13,9 +13,16 @@ var loadCmd = &cobra.Command{
 	Run:     runLoad,
 }
 
+// allowUnresolved loads the rules even when DNS does not work, only the boot
+// unit needs this since it runs before the network is up
+var allowUnresolved bool
+
 func init() {
 	RootCmd.AddCommand(loadCmd)
 
+	loadCmd.Flags().BoolVar(&allowUnresolved, "allow-unresolved", false,
+		"Load the rules when DNS is down, leaving out the hosts that do not resolve")
+
 	// #viperbug
 	// loadCmd.Flags().StringP("rules", "r", "",
 	// 	"The templated firewall rules")
@@ -26,5 +33,7 @@ func init() {
 }
 
 func runLoad(cmd *cobra.Command, args []string) {
+	requireFirewall()
+	requireUnlocked()
 	loadRules()
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gesquive/templr/iptables"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRulesWithoutDNS(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	// stand in iptables tools that remember the restored rules
+	restoredPath := path.Join(dirPath, "restored")
+	tools := map[string]string{
+		"iptables":         "#!/bin/sh\nexit 0\n",
+		"iptables-save":    "#!/bin/sh\nexit 0\n",
+		"iptables-restore": "#!/bin/sh\nfor arg; do rules=$arg; done\ncp $rules " + restoredPath + "\n",
+	}
+	for name, script := range tools {
+		err = ioutil.WriteFile(path.Join(dirPath, name), []byte(script), 0755)
+		assert.NoError(t, err, "test file write error")
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dirPath+":"+os.Getenv("PATH"))
+	assert.NoError(t, iptables.FindIPv4(), "unexpected error")
+
+	rulesPath := path.Join(dirPath, "rules.tr")
+	err = ioutil.WriteFile(rulesPath, []byte(`*filter
+{{ range lookupHosts (slice "192.0.2.1") }}-A INPUT -s {{ .Addr }} -j ACCEPT
+{{ end }}COMMIT
+`), 0644)
+	assert.NoError(t, err, "test file write error")
+
+	defer func(lookup func(string) ([]string, error)) { lookupHost = lookup }(lookupHost)
+	lookupHost = func(string) ([]string, error) {
+		return nil, errors.New("no dns servers")
+	}
+	viper.Set("rules", rulesPath)
+	viper.Set("state-dir", path.Join(dirPath, "state"))
+	defer viper.Reset()
+	runIPv4, runIPv6, managed, persist = true, false, false, false
+	defer func() { allowUnresolved = false }()
+	allowUnresolved = true
+
+	// exits the test binary on failure
+	loadRules()
+
+	restored, err := ioutil.ReadFile(restoredPath)
+	assert.NoError(t, err, "expected the rules to be restored")
+	assert.Contains(t, string(restored), "-A INPUT -s 192.0.2.1 -j ACCEPT", "rules do not match")
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"os"
+	"path"
+
+	"github.com/gesquive/templr/iptables"
+	"github.com/gesquive/templr/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// panicCmd represents the panic command
+var panicCmd = &cobra.Command{
+	Use:     "panic",
+	Aliases: []string{"lockdown"},
+	Short:   "Lock the firewall down to the management network",
+	Long: `Save the live firewall rules and replace them with rules that only allow
+loopback, established connections and the management network. Use --release
+to restore the saved rules. No templates or DNS lookups are used.`,
+	Run: runPanic,
+}
+
+func init() {
+	RootCmd.AddCommand(panicCmd)
+
+	panicCmd.Flags().StringSliceP("management-net", "m", []string{},
+		"CIDR range or address that can still reach the host")
+	panicCmd.Flags().Bool("release", false,
+		"Restore the rules saved before the lockdown")
+
+	viper.BindEnv("management-net")
+	viper.BindPFlag("management-net", panicCmd.Flags().Lookup("management-net"))
+}
+
+func runPanic(cmd *cobra.Command, args []string) {
+	requireFirewall()
+
+	stateDir := viper.GetString("state-dir")
+	if err := os.MkdirAll(stateDir, 0750); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(2)
+	}
+	savePath4 := path.Join(stateDir, "panic.ipv4.rules")
+	savePath6 := path.Join(stateDir, "panic.ipv6.rules")
+
+	release, _ := cmd.Flags().GetBool("release")
+	if release {
+		releaseLockdown(stateDir, savePath4, savePath6)
+		return
+	}
+
+	managementNets := viper.GetStringSlice("management-net")
+	if err := iptables.CheckManagementNets(managementNets); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(2)
+	}
+	if len(managementNets) == 0 {
+		log.Warn("No management network configured, only loopback and established connections are allowed")
+	}
+
+	// keeps a running daemon from applying the normal rules over the lockdown
+	if err := state.SetPanic(stateDir, true); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(10)
+	}
+
+	failed := false
+	if runIPv4 {
+		log.Warn("Locking down IPv4 firewall")
+		if err := iptables.LockdownIPv4Rules(savePath4, managementNets); err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		}
+	}
+
+	if runIPv6 {
+		log.Warn("Locking down IPv6 firewall")
+		if err := iptables.LockdownIPv6Rules(savePath6, managementNets); err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		}
+	}
+
+	if !lockedDown(savePath4, savePath6) {
+		// nothing was saved, so there is nothing for --release to restore
+		if err := state.SetPanic(stateDir, false); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+	if failed {
+		os.Exit(10)
+	}
+	log.Info("Run 'templr panic --release' to restore the previous rules")
+}
+
+func releaseLockdown(stateDir string, savePath4 string, savePath6 string) {
+	failed := false
+	if runIPv4 {
+		failed = !releaseFamily("IPv4", savePath4, iptables.ReleaseIPv4Rules) || failed
+	}
+	if runIPv6 {
+		failed = !releaseFamily("IPv6", savePath6, iptables.ReleaseIPv6Rules) || failed
+	}
+
+	if failed {
+		os.Exit(10)
+	}
+	// the other family may still be locked down
+	if lockedDown(savePath4, savePath6) {
+		return
+	}
+	if err := state.SetPanic(stateDir, false); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(10)
+	}
+}
+
+func releaseFamily(name string, savePath string, release func(string) error) bool {
+	if _, err := os.Stat(savePath); os.IsNotExist(err) {
+		log.Infof("No %s rules were saved before the lockdown, nothing to restore", name)
+		return true
+	}
+	log.Infof("Restoring %s rules saved before the lockdown", name)
+	if err := release(savePath); err != nil {
+		log.Errorf("%v", err)
+		return false
+	}
+	return true
+}
+
+// lockedDown tells if any family still has the rules from before a lockdown
+// saved
+func lockedDown(savePaths ...string) bool {
+	for _, savePath := range savePaths {
+		if _, err := os.Stat(savePath); err == nil {
+			return true
+		}
+	}
+	return false
+}
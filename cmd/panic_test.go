@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gesquive/templr/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleaseLockdownWithoutSavedRules(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(stateDir) // clean up
+
+	defer func(v4, v6 bool) { runIPv4, runIPv6 = v4, v6 }(runIPv4, runIPv6)
+	runIPv4, runIPv6 = true, true
+
+	// a lockdown that failed before saving anything
+	assert.NoError(t, state.SetPanic(stateDir, true), "unexpected error")
+	releaseLockdown(stateDir, path.Join(stateDir, "panic.ipv4.rules"), path.Join(stateDir, "panic.ipv6.rules"))
+	assert.False(t, state.Panicked(stateDir), "the lockdown marker should be cleared")
+}
@@ -1,6 +1,11 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"os"
+
+	"github.com/gesquive/cli"
+	"github.com/spf13/cobra"
+)
 
 // reloadCmd represents the reload command
 var reloadCmd = &cobra.Command{
@@ -24,6 +29,12 @@ func init() {
 }
 
 func runReload(cmd *cobra.Command, args []string) {
-	unloadRules()
+	requireFirewall()
+	requireUnlocked()
+	if !unloadRules() {
+		// loading on top of a half unloaded firewall could leave it in any state
+		cli.Error("Could not unload the rules, not loading them again")
+		os.Exit(10)
+	}
 	loadRules()
 }
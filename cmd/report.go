@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/gesquive/cli"
+	"github.com/gesquive/templr/iptables"
+	"github.com/gesquive/templr/report"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report on the live firewall rules",
+	Long:  `Reports built from the live firewall rules.`,
+}
+
+// hitsCmd represents the report hits command
+var hitsCmd = &cobra.Command{
+	Use:   "hits",
+	Short: "Report the hits of each template line",
+	Long: `Add up the packet and byte counters of the live rules by the template file
+and line in their provenance comment, so you can see which parts of the
+templates carry traffic. Needs rules applied with provenance on.
+
+By default the hits are counted since the rules were last applied. Save a
+snapshot with --save and pass it to --compare later to get the hits and the
+rates since the snapshot. Add --to with a later snapshot to compare two saved
+snapshots instead of the live rules.`,
+	Run: runHits,
+}
+
+func init() {
+	RootCmd.AddCommand(reportCmd)
+	reportCmd.AddCommand(hitsCmd)
+
+	hitsCmd.Flags().String("save", "",
+		"Save a snapshot of the hits to this file")
+	hitsCmd.Flags().String("compare", "",
+		"Count the hits since the snapshot in this file")
+	hitsCmd.Flags().String("to", "",
+		"Count the hits up to the snapshot in this file instead of the live rules")
+	hitsCmd.Flags().Bool("total", false,
+		"Report the total hits instead of the hits since the last apply")
+	hitsCmd.Flags().StringP("output", "o", "table",
+		"The output format, one of table or json")
+}
+
+func runHits(cmd *cobra.Command, args []string) {
+	savePath, _ := cmd.Flags().GetString("save")
+	comparePath, _ := cmd.Flags().GetString("compare")
+	toPath, _ := cmd.Flags().GetString("to")
+	total, _ := cmd.Flags().GetBool("total")
+	output, _ := cmd.Flags().GetString("output")
+	if output != "table" && output != "json" {
+		cli.Error("Unknown output format '%s'", output)
+		os.Exit(2)
+	}
+
+	var current *report.Snapshot
+	var err error
+	if len(toPath) > 0 {
+		if current, err = report.LoadSnapshot(toPath); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(2)
+		}
+	} else {
+		requireFirewall()
+		var live map[iptables.Family]*iptables.Rules
+		if live, err = liveRules(); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(10)
+		}
+		current = report.TakeSnapshot([]*iptables.Rules{live[iptables.IPv4], live[iptables.IPv6]},
+			viper.GetString("provenance-format"))
+	}
+
+	var baseline *report.Snapshot
+	since := "since the rules were applied"
+	switch {
+	case len(comparePath) > 0:
+		if baseline, err = report.LoadSnapshot(comparePath); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(2)
+		}
+		since = "since the snapshot taken " + formatTime(baseline.Taken)
+	case total:
+		since = "in total"
+	default:
+		baseline = appliedSnapshot()
+		if baseline == nil {
+			since = "in total, no apply was recorded"
+		}
+	}
+
+	if len(savePath) > 0 {
+		if err = current.Save(savePath); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(10)
+		}
+		log.Infof("Saved a snapshot to %s", savePath)
+	}
+
+	hits := current.Since(baseline)
+	if output == "json" {
+		data, _ := json.MarshalIndent(hits, "", "  ")
+		cli.Info("%s", data)
+		return
+	}
+	if len(hits) == 0 {
+		cli.Info("No rules with provenance comments found, apply the rules with --provenance")
+		return
+	}
+	cli.Info("Hits %s", since)
+	cli.Info("%s", bytes.TrimRight(formatHits(hits, baseline != nil), "\n"))
+}
+
+// appliedSnapshot returns the snapshot taken when the rules of the enabled
+// families were applied, nil if there is none
+func appliedSnapshot() *report.Snapshot {
+	var baseline *report.Snapshot
+	stateDir := viper.GetString("state-dir")
+	for _, family := range enabledFamilies() {
+		snapshotPath := path.Join(stateDir, familyName(family)+".hits.json")
+		snapshot, err := report.LoadSnapshot(snapshotPath)
+		if err != nil {
+			log.Debugf("report: %v", err)
+			continue
+		}
+		if baseline == nil {
+			baseline = snapshot
+		} else {
+			baseline.Merge(snapshot)
+		}
+	}
+	return baseline
+}
+
+// saveAppliedSnapshot remembers the hits right after an apply, so the report
+// can count the hits since
+func saveAppliedSnapshot(name string, live *iptables.Rules) error {
+	snapshot := report.TakeSnapshot([]*iptables.Rules{live}, viper.GetString("provenance-format"))
+	return snapshot.Save(path.Join(viper.GetString("state-dir"), name+".hits.json"))
+}
+
+func formatHits(hits []report.Hits, withRates bool) []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	if withRates {
+		fmt.Fprintln(w, "SOURCE\tRULES\tPACKETS\tBYTES\tPACKETS/S\tBYTES/S\t")
+	} else {
+		fmt.Fprintln(w, "SOURCE\tRULES\tPACKETS\tBYTES\t")
+	}
+	for _, hit := range hits {
+		source := hit.Source()
+		if len(source) == 0 {
+			source = "(tagged rules)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t", source, hit.Rules, hit.Packets, hit.Bytes)
+		if withRates {
+			fmt.Fprintf(w, "%.2f\t%.2f\t", hit.PacketRate, hit.ByteRate)
+		}
+		if hit.Packets == 0 {
+			fmt.Fprint(w, "no hits")
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func familyName(family iptables.Family) string {
+	if family == iptables.IPv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
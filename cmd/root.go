@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/gesquive/cli"
+	"github.com/gesquive/templr/daemon"
 	"github.com/gesquive/templr/engine"
 	"github.com/gesquive/templr/iptables"
+	"github.com/gesquive/templr/state"
 	homedir "github.com/mitchellh/go-homedir"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -27,6 +29,7 @@ var showVersion bool
 var runIPv4 bool
 var runIPv6 bool
 var persist bool
+var managed bool
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -63,11 +66,23 @@ func init() {
 		"Apply command to IPv6 rules only.")
 	RootCmd.PersistentFlags().BoolP("persist", "p", false,
 		"Save the firewall configuration to netfilter-persistent")
+	RootCmd.PersistentFlags().Bool("managed-chains", false,
+		"Only replace the chains templr owns, leave all other chains alone")
+	RootCmd.PersistentFlags().String("chain-prefix", "",
+		"In managed mode, also own every chain that starts with this prefix")
+	RootCmd.PersistentFlags().String("socket", daemon.DefaultSocketPath,
+		"The control socket of the templr daemon")
+	RootCmd.PersistentFlags().Bool("provenance", false,
+		"Comment every rule with the template file and line it came from")
+	RootCmd.PersistentFlags().String("provenance-format", engine.DefaultProvenance,
+		"The provenance comment, {file} and {line} are filled in")
 
 	// This is a workaround for https://github.com/spf13/viper/issues/233
 	//TODO: remove this once bug is fixed #viperbug
 	RootCmd.PersistentFlags().StringP("rules", "r", "",
 		"The templated firewall rules")
+	RootCmd.PersistentFlags().StringP("unload-rules", "u", "",
+		"The templated firewall rules to load on unload instead of accepting all traffic")
 
 	RootCmd.PersistentFlags().BoolVarP(&logDebug, "debug", "D", false,
 		"Write debug messages to console")
@@ -83,11 +98,28 @@ func init() {
 	viper.BindEnv("ipv6-only")
 	viper.BindEnv("persist")
 	viper.BindEnv("rules")
+	viper.BindEnv("unload-rules")
+	viper.BindEnv("managed-chains")
+	viper.BindEnv("chain-prefix")
+	viper.BindEnv("state-dir")
+	viper.BindEnv("socket")
+	viper.BindEnv("provenance")
+	viper.BindEnv("provenance-format")
+	viper.BindEnv("cloud-cache-ttl")
 
 	viper.BindPFlag("ipv4-only", RootCmd.PersistentFlags().Lookup("ipv4-only"))
 	viper.BindPFlag("ipv6-only", RootCmd.PersistentFlags().Lookup("ipv6-only"))
 	viper.BindPFlag("persist", RootCmd.PersistentFlags().Lookup("persist"))
 	viper.BindPFlag("rules", RootCmd.PersistentFlags().Lookup("rules"))
+	viper.BindPFlag("unload-rules", RootCmd.PersistentFlags().Lookup("unload-rules"))
+	viper.BindPFlag("managed-chains", RootCmd.PersistentFlags().Lookup("managed-chains"))
+	viper.BindPFlag("chain-prefix", RootCmd.PersistentFlags().Lookup("chain-prefix"))
+	viper.BindPFlag("socket", RootCmd.PersistentFlags().Lookup("socket"))
+	viper.BindPFlag("provenance", RootCmd.PersistentFlags().Lookup("provenance"))
+	viper.BindPFlag("provenance-format", RootCmd.PersistentFlags().Lookup("provenance-format"))
+
+	viper.SetDefault("state-dir", state.DefaultDir)
+	viper.SetDefault("cloud-cache-ttl", engine.DefaultCloudCacheTTL)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -155,6 +187,9 @@ func preRun(cmd *cobra.Command, args []string) {
 	persist = viper.GetBool("persist")
 	log.Debugf("config: persist=%t", persist)
 
+	managed = viper.GetBool("managed-chains")
+	log.Debugf("config: managed-chains=%t chain-prefix=%s", managed, viper.GetString("chain-prefix"))
+
 	ipv4Only := viper.GetBool("ipv4-only")
 	ipv6Only := viper.GetBool("ipv6-only")
 	if ipv4Only == ipv6Only {
@@ -168,16 +203,25 @@ func preRun(cmd *cobra.Command, args []string) {
 		runIPv6 = true
 	}
 	log.Debugf("config: runIPv4=%t runIPv6=%t", runIPv4, runIPv6)
+}
 
-	if err := iptables.FindIPv4(); runIPv4 && err != nil {
-		cli.Error("%s", err)
-		cli.Error("Make sure iptables is installed")
-		os.Exit(6)
+// requireFirewall makes sure the iptables tools are installed and that we
+// have the privileges to use them. Only commands that touch the live firewall
+// should call this, so rules can still be rendered as a normal user.
+func requireFirewall() {
+	if runIPv4 {
+		if err := iptables.FindIPv4(); err != nil {
+			cli.Error("%s", err)
+			cli.Error("Make sure iptables is installed")
+			os.Exit(6)
+		}
 	}
-	if err := iptables.FindIPv6(); runIPv6 && err != nil {
-		cli.Error("%s", err)
-		cli.Error("Make sure ip6tables is installed")
-		os.Exit(6)
+	if runIPv6 {
+		if err := iptables.FindIPv6(); err != nil {
+			cli.Error("%s", err)
+			cli.Error("Make sure ip6tables is installed")
+			os.Exit(6)
+		}
 	}
 
 	if !isRootUser() {
@@ -186,6 +230,15 @@ func preRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+// requireUnlocked keeps commands that change the rules from replacing an
+// active lockdown, including the boot unit
+func requireUnlocked() {
+	if state.Panicked(viper.GetString("state-dir")) {
+		cli.Error("The firewall is locked down, run 'templr panic --release' first")
+		os.Exit(10)
+	}
+}
+
 func getLogFilePath(defaultPath string) (logPath string) {
 	fi, err := os.Stat(defaultPath)
 	if err == nil && fi.IsDir() {
@@ -201,14 +254,39 @@ func isRootUser() bool {
 	return uid == 0
 }
 
+// lookupHost checks that DNS works before loading, tests replace it
+var lookupHost = net.LookupHost
+
 func isDNSWorking() bool {
-	addrs, err := net.LookupHost("github.com")
+	addrs, err := lookupHost("github.com")
 	if err != nil {
 		return false
 	}
 	return len(addrs) != 0
 }
 
+// rulesetOptions returns how templates should be read
+func rulesetOptions() engine.Options {
+	options := engine.Options{
+		CloudRanges: viper.GetStringMapString("cloud-ranges"),
+		CacheDir:    path.Join(viper.GetString("state-dir"), "cloud"),
+		CacheTTL:    viper.GetDuration("cloud-cache-ttl"),
+	}
+	if viper.GetBool("provenance") {
+		options.Provenance = viper.GetString("provenance-format")
+	}
+	return options
+}
+
+// renderRules generates the firewall rules from the given template
+func renderRules(rulePath string) ([]byte, error) {
+	rules, err := engine.NewRulesetWithOptions(rulePath, rulesetOptions())
+	if err != nil {
+		return nil, err
+	}
+	return rules.GenerateRules(displayVersion)
+}
+
 func loadRules() {
 	rulePath := viper.GetString("rules")
 	if len(rulePath) == 0 {
@@ -217,50 +295,319 @@ func loadRules() {
 	}
 
 	if !isDNSWorking() {
-		cli.Error("DNS is not resolving")
-		os.Exit(4)
+		if !allowUnresolved {
+			cli.Error("DNS is not resolving")
+			os.Exit(4)
+		}
+		// the boot unit loads the rules before the network is up, hosts that
+		// do not resolve are left out until the daemon refreshes them
+		log.Warn("DNS is not resolving, hosts that cannot be looked up are left out of the rules")
 	}
 
-	rules, err := engine.NewRuleset(rulePath)
+	data, err := renderRules(rulePath)
 	if err != nil {
-		log.Error("%v", err)
+		log.Errorf("%v", err)
 		os.Exit(2)
 	}
 
-	data, err := rules.GenerateRules(displayVersion)
-	if err != nil {
-		log.Error("%v", err)
-		os.Exit(2)
+	if err = applyRules(data); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(10)
 	}
+}
 
+// applyRules loads the generated rules into the firewall of each ip family
+func applyRules(data []byte) error {
 	// right now, don't see a reason to make this an option
 	restoreCounters := true
 
 	if runIPv4 {
 		log.Info("Applying IPv4 firewall rules")
-		err := iptables.LoadIPv4Rules(data, restoreCounters, persist)
+		input := data
+		if restoreCounters {
+			input = withLiveCounters("ipv4", data, iptables.IPv4, iptables.GetIPv4Rules)
+		}
+		var err error
+		if managed {
+			err = applyManagedRules("ipv4", input, restoreCounters, iptables.ApplyManagedIPv4Rules)
+		} else {
+			// the counters are only for the restore, the generated rules
+			// are what gets persisted
+			err = iptables.LoadIPv4Rules(input, restoreCounters, false)
+			if err == nil && persist {
+				err = iptables.PersistIPv4Rules(data)
+			}
+		}
 		if err != nil {
-			log.Error("%v", err)
-			os.Exit(10)
+			return err
 		}
+		recordApplied("ipv4", data, iptables.IPv4, iptables.GetIPv4Rules)
 	}
 
 	if runIPv6 {
 		log.Info("Applying IPv6 firewall rules")
-		err := iptables.LoadIPv6Rules(data, restoreCounters, persist)
+		input := data
+		if restoreCounters {
+			input = withLiveCounters("ipv6", data, iptables.IPv6, iptables.GetIPv6Rules)
+		}
+		var err error
+		if managed {
+			err = applyManagedRules("ipv6", input, restoreCounters, iptables.ApplyManagedIPv6Rules)
+		} else {
+			// the counters are only for the restore, the generated rules
+			// are what gets persisted
+			err = iptables.LoadIPv6Rules(input, restoreCounters, false)
+			if err == nil && persist {
+				err = iptables.PersistIPv6Rules(data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		recordApplied("ipv6", data, iptables.IPv6, iptables.GetIPv6Rules)
+	}
+	return nil
+}
+
+// validateRules checks that iptables accepts the generated rules for each
+// ip family without applying them
+func validateRules(data []byte) error {
+	if runIPv4 {
+		if err := iptables.TestIPv4Rules(data); err != nil {
+			return err
+		}
+	}
+	if runIPv6 {
+		if err := iptables.TestIPv6Rules(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unloadRules loads the unload rules, or clears the firewall if there are
+// none, and returns false if anything failed
+func unloadRules() bool {
+	unloadPath := viper.GetString("unload-rules")
+	if len(unloadPath) == 0 {
+		if managed {
+			return unloadManagedRules()
+		}
+		return clearRules()
+	}
+
+	data, err := renderRules(unloadPath)
+	if err != nil {
+		// never fall back on accepting everything when the unload rules are broken
+		log.Errorf("%v", err)
+		return false
+	}
+
+	ok := true
+	if runIPv4 {
+		log.Info("Applying IPv4 unload rules")
+		var err error
+		if managed {
+			err = applyManagedRules("ipv4", data, false, iptables.ApplyManagedIPv4Rules)
+		} else {
+			var cleared []iptables.ClearedTable
+			cleared, err = iptables.UnloadIPv4Rules(data, persist)
+			logCleared("IPv4", cleared)
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			ok = false
+		} else {
+			forgetApplied("ipv4")
+		}
+	}
+
+	if runIPv6 {
+		log.Info("Applying IPv6 unload rules")
+		var err error
+		if managed {
+			err = applyManagedRules("ipv6", data, false, iptables.ApplyManagedIPv6Rules)
+		} else {
+			var cleared []iptables.ClearedTable
+			cleared, err = iptables.UnloadIPv6Rules(data, persist)
+			logCleared("IPv6", cleared)
+		}
 		if err != nil {
-			log.Error("%v", err)
-			os.Exit(10)
+			log.Errorf("%v", err)
+			ok = false
+		} else {
+			forgetApplied("ipv6")
 		}
 	}
+	return ok
 }
 
-func unloadRules() {
+func clearRules() bool {
+	ok := true
 	if runIPv4 {
-		iptables.ClearIPv4Rules(persist)
+		log.Info("Clearing IPv4 firewall rules")
+		cleared, err := iptables.ClearIPv4Rules(persist)
+		logCleared("IPv4", cleared)
+		if err != nil {
+			log.Errorf("%v", err)
+			ok = false
+		} else {
+			forgetApplied("ipv4")
+		}
 	}
 
 	if runIPv6 {
-		iptables.ClearIPv6Rules(persist)
+		log.Info("Clearing IPv6 firewall rules")
+		cleared, err := iptables.ClearIPv6Rules(persist)
+		logCleared("IPv6", cleared)
+		if err != nil {
+			log.Errorf("%v", err)
+			ok = false
+		} else {
+			forgetApplied("ipv6")
+		}
+	}
+	return ok
+}
+
+func logCleared(family string, cleared []iptables.ClearedTable) {
+	for _, table := range cleared {
+		log.Infof("Cleared %s %s table: %d rules, %d chains %v",
+			family, table.Name, table.Rules, len(table.Chains), table.Chains)
+	}
+}
+
+type managedApplyFunc func([]byte, iptables.ManagedChains, bool, bool) (map[string][]string, error)
+type managedUnloadFunc func(iptables.ManagedChains, bool) error
+
+// applyManagedRules applies the rules to the chains templr owns and remembers
+// them so they can be cleaned up once the template stops using them
+func applyManagedRules(name string, data []byte, restoreCounters bool, apply managedApplyFunc) error {
+	stateDir := viper.GetString("state-dir")
+	record, err := state.Load(stateDir, name)
+	if err != nil {
+		return err
+	}
+
+	chains := iptables.ManagedChains{
+		Prefix: viper.GetString("chain-prefix"),
+		Owned:  record.Chains,
+	}
+	owned, err := apply(data, chains, restoreCounters, persist)
+	if err != nil {
+		return err
+	}
+	log.Debugf("managed: %s owned chains=%v", name, owned)
+
+	record.Chains = owned
+	return record.Save(stateDir, name)
+}
+
+func unloadManagedRules() bool {
+	ok := true
+	if runIPv4 {
+		log.Info("Releasing IPv4 managed chains")
+		if err := unloadManagedFamily("ipv4", iptables.UnloadManagedIPv4Rules); err != nil {
+			log.Errorf("%v", err)
+			ok = false
+		}
+	}
+
+	if runIPv6 {
+		log.Info("Releasing IPv6 managed chains")
+		if err := unloadManagedFamily("ipv6", iptables.UnloadManagedIPv6Rules); err != nil {
+			log.Errorf("%v", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func unloadManagedFamily(name string, unload managedUnloadFunc) error {
+	stateDir := viper.GetString("state-dir")
+	record, err := state.Load(stateDir, name)
+	if err != nil {
+		return err
+	}
+
+	chains := iptables.ManagedChains{
+		Prefix: viper.GetString("chain-prefix"),
+		Owned:  record.Chains,
+	}
+	if err = unload(chains, persist); err != nil {
+		return err
+	}
+
+	record.Chains = nil
+	record.Forget()
+	return record.Save(stateDir, name)
+}
+
+type liveRulesFunc func() (*iptables.Rules, error)
+
+// recordApplied remembers the rules that were applied to the family, so we
+// can tell when the live rules drift from them. Failing to record is not a
+// reason to fail the apply.
+func recordApplied(name string, data []byte, family iptables.Family, getLive liveRulesFunc) {
+	stateDir := viper.GetString("state-dir")
+	record, err := state.Load(stateDir, name)
+	if err == nil {
+		var rules, live *iptables.Rules
+		if rules, err = iptables.ParseRules(data, family); err == nil {
+			live, err = getLive()
+		}
+		if err == nil {
+			record.Hash = engine.RulesHash(data)
+			record.AppliedAt = time.Now()
+			record.Rules = string(expectedRules(live, record).Bytes())
+			record.Specs = iptables.LearnSpecs(rules, live)
+			err = record.Save(stateDir, name)
+		}
+		if err == nil {
+			err = saveAppliedSnapshot(name, live)
+		}
+	}
+	if err != nil {
+		log.Warnf("Could not record the applied %s rules: %v", name, err)
+	}
+}
+
+// withLiveCounters returns the rules with the counters of the live rules that
+// did not change, so applying them again does not reset their counters
+func withLiveCounters(name string, data []byte, family iptables.Family, getLive liveRulesFunc) []byte {
+	record, err := state.Load(viper.GetString("state-dir"), name)
+	if err == nil {
+		var rules, live *iptables.Rules
+		if rules, err = iptables.ParseRules(data, family); err == nil {
+			if live, err = getLive(); err == nil {
+				iptables.CarryCounters(rules, live, record.Specs)
+				return rules.Bytes()
+			}
+		}
+	}
+	log.Warnf("Could not carry over the %s counters: %v", name, err)
+	return data
+}
+
+// forgetApplied drops the record of the last apply once the rules are gone
+func forgetApplied(name string) {
+	stateDir := viper.GetString("state-dir")
+	record, err := state.Load(stateDir, name)
+	if err == nil {
+		record.Forget()
+		err = record.Save(stateDir, name)
+	}
+	if err != nil {
+		log.Warnf("Could not update the %s state: %v", name, err)
+	}
+}
+
+// expectedRules returns the part of the live rules that templr is
+// responsible for, without counters
+func expectedRules(live *iptables.Rules, record *state.Record) *iptables.Rules {
+	rules := live.Normalized()
+	if managed {
+		rules = rules.Select(record.Chains)
 	}
+	return rules
 }
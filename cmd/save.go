@@ -36,7 +36,7 @@ func init() {
 func runSave(cmd *cobra.Command, args []string) {
 	rulePath := viper.GetString("rules")
 
-	rules, err := engine.NewRuleset(rulePath)
+	rules, err := engine.NewRulesetWithOptions(rulePath, rulesetOptions())
 	if err != nil {
 		cli.Error("%v", err)
 		os.Exit(2)
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/gesquive/cli"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// the boot unit loads the rules before any network interface comes up, the
+// daemon unit keeps them up to date once the network is online
+const bootUnitTemplate = `[Unit]
+Description=Load the templr firewall rules
+Documentation=https://github.com/gesquive/templr
+DefaultDependencies=no
+Wants=network-pre.target
+Before=network-pre.target shutdown.target
+After=local-fs.target
+Conflicts=shutdown.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart={{ .Command }} up --allow-unresolved
+ExecReload={{ .Command }} reload
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const daemonUnitTemplate = `[Unit]
+Description=Keep the templr firewall rules up to date
+Documentation=https://github.com/gesquive/templr
+Wants=network-online.target
+After=network-online.target {{ .BootUnit }}
+
+[Service]
+Type=notify
+ExecStart={{ .Command }} daemon
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+WatchdogSec=2min
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// serviceCmd represents the install-service command
+var serviceCmd = &cobra.Command{
+	Use:   "install-service",
+	Short: "Write the systemd units for templr",
+	Long: `Write a oneshot unit that loads the rules at boot, before the network
+comes up, and a unit that runs the daemon once the network is online. Both
+units use the current config file. Enable them with systemctl afterwards.`,
+	Run: runInstallService,
+}
+
+func init() {
+	RootCmd.AddCommand(serviceCmd)
+
+	serviceCmd.Flags().String("unit-dir", "/etc/systemd/system",
+		"The directory to write the units to")
+	serviceCmd.Flags().String("unit-name", "templr",
+		"The name of the boot unit, the daemon unit gets a -daemon suffix")
+	serviceCmd.Flags().Bool("dry-run", false,
+		"Print the units instead of writing them")
+}
+
+func runInstallService(cmd *cobra.Command, args []string) {
+	unitDir, _ := cmd.Flags().GetString("unit-dir")
+	unitName, _ := cmd.Flags().GetString("unit-name")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	command, err := getServiceCommand()
+	if err != nil {
+		cli.Error("%v", err)
+		os.Exit(2)
+	}
+
+	bootUnit := unitName + ".service"
+	daemonUnit := unitName + "-daemon.service"
+	units := []struct {
+		name     string
+		template string
+	}{
+		{bootUnit, bootUnitTemplate},
+		{daemonUnit, daemonUnitTemplate},
+	}
+
+	for _, unit := range units {
+		var buf bytes.Buffer
+		t := template.Must(template.New(unit.name).Parse(unit.template))
+		err = t.Execute(&buf, map[string]string{
+			"Command":  command,
+			"BootUnit": bootUnit,
+		})
+		if err != nil {
+			log.Errorf("Could not render %s: %v", unit.name, err)
+			os.Exit(10)
+		}
+
+		if dryRun {
+			cli.Info("# %s", unit.name)
+			cli.Info("%s", buf.String())
+			continue
+		}
+
+		unitPath := path.Join(unitDir, unit.name)
+		if err = ioutil.WriteFile(unitPath, buf.Bytes(), 0644); err != nil {
+			log.Errorf("Could not write unit: %v", err)
+			os.Exit(10)
+		}
+		log.Infof("Wrote %s", unitPath)
+	}
+
+	if !dryRun {
+		log.Infof("Run 'systemctl daemon-reload && systemctl enable %s %s' to use them",
+			bootUnit, daemonUnit)
+	}
+}
+
+// getServiceCommand returns how the units should run templr, with the config
+// file we are using now
+func getServiceCommand() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	configFile := cfgFile
+	if len(configFile) == 0 {
+		configFile = viper.ConfigFileUsed()
+	}
+	if len(configFile) == 0 {
+		log.Warn("No config file found, the units will run without one")
+		return systemdQuote(executable), nil
+	}
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return "", err
+	}
+	return systemdQuote(executable) + " --config " + systemdQuote(configFile), nil
+}
+
+// systemdQuote makes an argument safe for ExecStart=, quoting it when it has
+// spaces and escaping the specifiers and variables systemd would expand
+func systemdQuote(arg string) string {
+	quoted := strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if !strings.ContainsAny(arg, " \t\\\"'") {
+		return quoted
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(quoted) + `"`
+}
@@ -0,0 +1,14 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	assert.Equal(t, "/usr/local/bin/templr", systemdQuote("/usr/local/bin/templr"))
+	assert.Equal(t, `"/etc/my templr/config.yml"`, systemdQuote("/etc/my templr/config.yml"))
+	assert.Equal(t, `"/etc/templr/\"a\" b.yml"`, systemdQuote(`/etc/templr/"a" b.yml`))
+	assert.Equal(t, "/etc/templr/100%%$$HOME.yml", systemdQuote("/etc/templr/100%$HOME.yml"))
+}
@@ -1,34 +1,196 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
 	"github.com/gesquive/cli"
 	"github.com/gesquive/templr/iptables"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Report the firewall status",
-	Long:  `Retrieves a summary of the current firewall(s).`,
-	Run:   runStatus,
+	Long: `Reports the live rules and counters of the firewall(s), along with the
+hash of the templr rules that were last applied and whether the live rules
+drifted from them since. Run verify to see what changed.`,
+	Run: runStatus,
 }
 
 func init() {
 	RootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().StringP("output", "o", "table",
+		"The output format, one of table, json or yaml")
+}
+
+type familyStatus struct {
+	Family    string        `json:"family" yaml:"family"`
+	Hash      string        `json:"hash,omitempty" yaml:"hash,omitempty"`
+	AppliedAt *time.Time    `json:"applied_at,omitempty" yaml:"applied_at,omitempty"`
+	Drifted   bool          `json:"drifted" yaml:"drifted"`
+	Tables    []tableStatus `json:"tables" yaml:"tables"`
+}
+
+type tableStatus struct {
+	Name   string        `json:"name" yaml:"name"`
+	Chains []chainStatus `json:"chains" yaml:"chains"`
+}
+
+type chainStatus struct {
+	Name    string       `json:"name" yaml:"name"`
+	Policy  string       `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Packets uint64       `json:"packets" yaml:"packets"`
+	Bytes   uint64       `json:"bytes" yaml:"bytes"`
+	Rules   []ruleStatus `json:"rules" yaml:"rules"`
+}
+
+type ruleStatus struct {
+	Rule    string `json:"rule" yaml:"rule"`
+	Comment string `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Packets uint64 `json:"packets" yaml:"packets"`
+	Bytes   uint64 `json:"bytes" yaml:"bytes"`
 }
 
 func runStatus(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "table" && output != "json" && output != "yaml" {
+		cli.Error("Unknown output format '%s'", output)
+		os.Exit(2)
+	}
+	requireFirewall()
+
+	statuses := []familyStatus{}
+	failed := false
 	if runIPv4 {
-		cli.Info("IPv4 Firewall Status")
-		cli.Info("----------------------------------------------------")
-		status := iptables.GetIPv4Summary()
-		cli.Info(status)
+		status, err := getFamilyStatus("ipv4", iptables.GetIPv4Rules)
+		if err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		} else {
+			statuses = append(statuses, *status)
+		}
 	}
 	if runIPv6 {
-		cli.Info("IPv6 Firewall Status")
-		cli.Info("----------------------------------------------------")
-		status := iptables.GetIPv6Summary()
-		cli.Info(status)
+		status, err := getFamilyStatus("ipv6", iptables.GetIPv6Rules)
+		if err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		} else {
+			statuses = append(statuses, *status)
+		}
+	}
+
+	switch output {
+	case "json":
+		data, _ := json.MarshalIndent(statuses, "", "  ")
+		cli.Info("%s", data)
+	case "yaml":
+		data, _ := yaml.Marshal(statuses)
+		cli.Info("%s", bytes.TrimRight(data, "\n"))
+	default:
+		cli.Info("%s", bytes.TrimRight(formatStatus(statuses), "\n"))
+	}
+
+	if failed {
+		os.Exit(10)
+	}
+}
+
+func getFamilyStatus(name string, getLive liveRulesFunc) (*familyStatus, error) {
+	live, err := getLive()
+	if err != nil {
+		return nil, err
+	}
+	record, diffs, err := checkDrift(name, live)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &familyStatus{Family: name, Tables: []tableStatus{}}
+	if record.Applied() {
+		status.Hash = record.Hash
+		status.AppliedAt = &record.AppliedAt
+		status.Drifted = len(diffs) > 0
+	}
+
+	for _, table := range live.Tables {
+		tableInfo := tableStatus{Name: table.Name, Chains: []chainStatus{}}
+		for _, chain := range table.Chains {
+			chainInfo := chainStatus{Name: chain.Name, Rules: []ruleStatus{}}
+			if chain.Policy != "-" {
+				chainInfo.Policy = chain.Policy
+				chainInfo.Packets = chain.Counters.Packets
+				chainInfo.Bytes = chain.Counters.Bytes
+			}
+			for _, rule := range table.ChainRules(chain.Name) {
+				ruleInfo := ruleStatus{Rule: rule.Spec, Comment: rule.Comment()}
+				if rule.Counters != nil {
+					ruleInfo.Packets = rule.Counters.Packets
+					ruleInfo.Bytes = rule.Counters.Bytes
+				}
+				chainInfo.Rules = append(chainInfo.Rules, ruleInfo)
+			}
+			tableInfo.Chains = append(tableInfo.Chains, chainInfo)
+		}
+		status.Tables = append(status.Tables, tableInfo)
+	}
+	return status, nil
+}
+
+// formatStatus lays the status out for people to read
+func formatStatus(statuses []familyStatus) []byte {
+	var buf bytes.Buffer
+	for _, status := range statuses {
+		fmt.Fprintf(&buf, "%s Firewall Status\n", familyTitle(status.Family))
+		fmt.Fprintln(&buf, "----------------------------------------------------")
+		if status.AppliedAt == nil {
+			fmt.Fprintln(&buf, "templr rules: none applied")
+		} else {
+			drift := "no drift"
+			if status.Drifted {
+				drift = "DRIFTED"
+			}
+			fmt.Fprintf(&buf, "templr rules: %.12s applied %s (%s)\n", status.Hash,
+				formatTime(*status.AppliedAt), drift)
+		}
+
+		for _, table := range status.Tables {
+			fmt.Fprintf(&buf, "\n*%s\n", table.Name)
+			for _, chain := range table.Chains {
+				if len(chain.Policy) > 0 {
+					fmt.Fprintf(&buf, "Chain %s (policy %s %d packets, %d bytes)\n",
+						chain.Name, chain.Policy, chain.Packets, chain.Bytes)
+				} else {
+					fmt.Fprintf(&buf, "Chain %s\n", chain.Name)
+				}
+				if len(chain.Rules) == 0 {
+					continue
+				}
+				w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+				fmt.Fprintln(w, "pkts\tbytes\t")
+				for _, rule := range chain.Rules {
+					fmt.Fprintf(w, "%d\t%d\t  %s\n", rule.Packets, rule.Bytes, rule.Rule)
+				}
+				w.Flush()
+			}
+		}
+		fmt.Fprintln(&buf)
+	}
+	return buf.Bytes()
+}
+
+func familyTitle(name string) string {
+	if name == "ipv6" {
+		return "IPv6"
 	}
+	return "IPv4"
 }
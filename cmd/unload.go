@@ -1,13 +1,17 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
 
 // unloadCmd represents the unload command
 var unloadCmd = &cobra.Command{
 	Use:     "unload",
 	Aliases: []string{"down", "stop", "clear"},
-	Short:   "Clear the firewall, accept all traffic",
-	Long:    `Clear the firewall, accept all traffic.`,
+	Short:   "Clear the firewall, or load the unload rules",
+	Long:    `Load the unload rules if configured, otherwise clear the firewall and accept all traffic.`,
 	Run:     runUnload,
 }
 
@@ -16,5 +20,9 @@ func init() {
 }
 
 func runUnload(cmd *cobra.Command, args []string) {
-	unloadRules()
+	requireFirewall()
+	requireUnlocked()
+	if !unloadRules() {
+		os.Exit(10)
+	}
 }
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/gesquive/cli"
+	"github.com/gesquive/templr/iptables"
+	"github.com/gesquive/templr/state"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the live rules against the last applied rules",
+	Long: `Compare the live rules with the rules templr applied last and list the
+rules that were added, removed or modified in each chain since. Exits with
+1 when the rules drifted.`,
+	Run: runVerify,
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringP("output", "o", "table",
+		"The output format, one of table or json")
+}
+
+type familyDrift struct {
+	Family  string               `json:"family"`
+	Hash    string               `json:"hash"`
+	Drifted bool                 `json:"drifted"`
+	Chains  []iptables.ChainDiff `json:"chains"`
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "table" && output != "json" {
+		cli.Error("Unknown output format '%s'", output)
+		os.Exit(2)
+	}
+	requireFirewall()
+
+	drifts := []familyDrift{}
+	failed := false
+	if runIPv4 {
+		drift, err := verifyFamily("ipv4", iptables.GetIPv4Rules)
+		if err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		} else {
+			drifts = append(drifts, *drift)
+		}
+	}
+	if runIPv6 {
+		drift, err := verifyFamily("ipv6", iptables.GetIPv6Rules)
+		if err != nil {
+			log.Errorf("%v", err)
+			failed = true
+		} else {
+			drifts = append(drifts, *drift)
+		}
+	}
+
+	drifted := false
+	for _, drift := range drifts {
+		drifted = drifted || drift.Drifted
+	}
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(drifts, "", "  ")
+		cli.Info("%s", data)
+	} else {
+		for _, drift := range drifts {
+			if !drift.Drifted {
+				cli.Info("%s rules match %.12s", familyTitle(drift.Family), drift.Hash)
+				continue
+			}
+			cli.Info("%s rules drifted from %.12s", familyTitle(drift.Family), drift.Hash)
+			for _, chain := range drift.Chains {
+				for _, line := range chain.Lines() {
+					cli.Info("  %s", line)
+				}
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(10)
+	}
+	if drifted {
+		os.Exit(1)
+	}
+}
+
+func verifyFamily(name string, getLive liveRulesFunc) (*familyDrift, error) {
+	live, err := getLive()
+	if err != nil {
+		return nil, err
+	}
+	record, diffs, err := checkDrift(name, live)
+	if err != nil {
+		return nil, err
+	}
+	if !record.Applied() {
+		return nil, errors.Errorf("no applied %s rules recorded, run 'templr up' first", name)
+	}
+	return &familyDrift{
+		Family:  name,
+		Hash:    record.Hash,
+		Drifted: len(diffs) > 0,
+		Chains:  diffs,
+	}, nil
+}
+
+// checkDrift compares the live rules of the family with the rules recorded
+// on the last apply. Nothing is compared when no apply was recorded.
+func checkDrift(name string, live *iptables.Rules) (*state.Record, []iptables.ChainDiff, error) {
+	record, err := state.Load(viper.GetString("state-dir"), name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !record.Applied() {
+		return record, []iptables.ChainDiff{}, nil
+	}
+
+	expected, err := iptables.ParseRules([]byte(record.Rules), iptables.AnyFamily)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "recorded %s rules", name)
+	}
+	return record, iptables.DiffRules(expected, expectedRules(live, record)), nil
+}
+
+// verifyRules describes how the live rules of each enabled family drifted
+// from the last applied rules, for the daemon
+func verifyRules() ([]string, error) {
+	lines := []string{}
+	check := func(name string, getLive liveRulesFunc) error {
+		live, err := getLive()
+		if err != nil {
+			return err
+		}
+		_, diffs, err := checkDrift(name, live)
+		if err != nil {
+			return err
+		}
+		for _, diff := range diffs {
+			for _, line := range diff.Lines() {
+				lines = append(lines, familyTitle(name)+" "+line)
+			}
+		}
+		return nil
+	}
+
+	if runIPv4 {
+		if err := check("ipv4", iptables.GetIPv4Rules); err != nil {
+			return nil, err
+		}
+	}
+	if runIPv6 {
+		if err := check("ipv6", iptables.GetIPv6Rules); err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
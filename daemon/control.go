@@ -0,0 +1,179 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gesquive/templr/engine"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSocketPath is where the daemon listens for control requests
+const DefaultSocketPath = "/run/templr.sock"
+
+// the commands a running daemon understands
+const (
+	CommandReload = "reload"
+	CommandStatus = "status"
+	CommandHosts  = "hosts"
+	CommandPause  = "pause"
+	CommandResume = "resume"
+)
+
+// controlTimeout limits how long a control connection can stay open, a
+// reload has to render the rules and can wait on DNS
+const controlTimeout = time.Minute
+
+// Request is sent to the control socket
+type Request struct {
+	Command string `json:"command"`
+}
+
+// Response is the answer to a Request
+type Response struct {
+	OK     bool                `json:"ok"`
+	Error  string              `json:"error,omitempty"`
+	Status *Status             `json:"status,omitempty"`
+	Hosts  []engine.HostStatus `json:"hosts,omitempty"`
+}
+
+// Status reports what the daemon last did
+type Status struct {
+	Paused     bool      `json:"paused"`
+	Pending    bool      `json:"pending"`
+	Drifted    bool      `json:"drifted"`
+	RulesHash  string    `json:"rules_hash"`
+	RenderedAt time.Time `json:"rendered_at"`
+	AppliedAt  time.Time `json:"applied_at"`
+	LastError  string    `json:"last_error,omitempty"`
+	ErrorAt    time.Time `json:"error_at"`
+}
+
+type controlRequest struct {
+	request Request
+	reply   chan Response
+}
+
+// SendCommand sends a command to the daemon listening on socketPath
+func SendCommand(socketPath string, command string) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connect to daemon")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err = json.NewEncoder(conn).Encode(Request{command}); err != nil {
+		return nil, errors.Wrapf(err, "send command")
+	}
+	response := new(Response)
+	if err = json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, errors.Wrapf(err, "read response")
+	}
+	return response, nil
+}
+
+// listenControl opens the control socket, replacing a stale socket left
+// behind by a daemon that did not shut down cleanly
+func listenControl(socketPath string) (net.Listener, error) {
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("a daemon is already listening on %s", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "control socket")
+	}
+	// the socket can change the firewall, keep it to ourselves
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "control socket")
+	}
+	return listener, nil
+}
+
+// serveControl passes the requests from the socket to the daemon loop, so
+// they never run at the same time as a refresh
+func serveControl(listener net.Listener, requests chan<- controlRequest, stop <-chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handleControlConn(conn, requests, stop)
+	}
+}
+
+func handleControlConn(conn net.Conn, requests chan<- controlRequest, stop <-chan struct{}) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var request Request
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	reply := make(chan Response, 1)
+	select {
+	case requests <- controlRequest{request, reply}:
+	case <-stop:
+		return
+	}
+	select {
+	case response := <-reply:
+		json.NewEncoder(conn).Encode(response)
+	case <-stop:
+	}
+}
+
+// handle runs a control request
+func (d *Daemon) handle(request Request) Response {
+	log.Debugf("daemon: control request '%s'", request.Command)
+	switch request.Command {
+	case CommandReload:
+		log.Info("Reload requested, reloading rules")
+		sdNotify(notifyReloading)
+		defer sdNotify(notifyReady)
+		if err := d.reloadTemplate(true); err != nil {
+			log.Errorf("Not applying changed rules: %v", err)
+			return Response{Error: err.Error(), Status: d.currentStatus()}
+		}
+	case CommandPause:
+		d.paused = true
+		log.Info("Automatic applies paused")
+		sdNotify(sdStatus("Automatic applies paused"))
+	case CommandResume:
+		d.paused = false
+		log.Info("Automatic applies resumed")
+		sdNotify(sdStatus("Automatic applies resumed"))
+		if d.pending {
+			log.Info("Applying updated firewall rules")
+			if err := d.apply(); err != nil {
+				log.Errorf("%v", err)
+				return Response{Error: err.Error(), Status: d.currentStatus()}
+			}
+		}
+	case CommandHosts:
+		return Response{OK: true, Hosts: d.ruleset.Resolver().Hosts()}
+	case CommandStatus:
+	default:
+		return Response{Error: fmt.Sprintf("unknown command '%s'", request.Command)}
+	}
+	return Response{OK: true, Status: d.currentStatus()}
+}
+
+func (d *Daemon) currentStatus() *Status {
+	status := d.status
+	status.Paused = d.paused
+	status.Pending = d.pending
+	return &status
+}
@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControlPauseResume(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	applied := [][]byte{}
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply: func(rules []byte) error {
+			applied = append(applied, rules)
+			return nil
+		},
+	})
+	assert.NoError(t, d.load(), "unexpected error")
+	hash := d.status.RulesHash
+	assert.NotEmpty(t, hash, "expected a rules hash")
+
+	response := d.handle(Request{CommandPause})
+	assert.True(t, response.OK, "unexpected error")
+	assert.True(t, response.Status.Paused, "expected the daemon to be paused")
+
+	err := ioutil.WriteFile(rulesPath, []byte("*filter\n-A INPUT -j DROP\nCOMMIT\n"), 0644)
+	assert.NoError(t, err, "test file write error")
+	assert.NoError(t, d.reloadTemplate(false), "unexpected error")
+	assert.Len(t, applied, 1, "rules were applied while paused")
+	assert.True(t, d.pending, "expected a pending apply")
+
+	response = d.handle(Request{CommandResume})
+	assert.True(t, response.OK, "unexpected error")
+	assert.False(t, response.Status.Paused, "expected the daemon to run")
+	assert.False(t, response.Status.Pending, "unexpected pending apply")
+	assert.Len(t, applied, 2, "expected the held back rules to be applied")
+	assert.NotEqual(t, hash, response.Status.RulesHash, "expected a new rules hash")
+
+	response = d.handle(Request{"bogus"})
+	assert.False(t, response.OK, "expected an error")
+}
+
+func TestControlSocket(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -s 192.0.2.10 -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+	socketDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(socketDir) // clean up
+	socketPath := path.Join(socketDir, "templr.sock")
+
+	d := New(Config{
+		RulesPath:  rulesPath,
+		Apply:      func(rules []byte) error { return nil },
+		SocketPath: socketPath,
+	})
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- d.Run(stop) }()
+
+	var response *Response
+	for i := 0; i < 100 && response == nil; i++ {
+		// wait for the daemon to start listening
+		time.Sleep(10 * time.Millisecond)
+		response, _ = SendCommand(socketPath, CommandStatus)
+	}
+	if response == nil {
+		t.Fatal("could not reach the daemon")
+	}
+	assert.True(t, response.OK, "unexpected error")
+	assert.NotEmpty(t, response.Status.RulesHash, "expected a rules hash")
+
+	response, err = SendCommand(socketPath, CommandReload)
+	assert.NoError(t, err, "unexpected error")
+	assert.True(t, response.OK, "unexpected error")
+
+	close(stop)
+	assert.NoError(t, <-done, "unexpected error")
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "the socket was not removed")
+}
@@ -0,0 +1,348 @@
+package daemon
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gesquive/templr/engine"
+	"github.com/gesquive/templr/iptables"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMinRefresh keeps short DNS TTLs from reloading the firewall too often
+const DefaultMinRefresh = 30 * time.Second
+
+// DefaultMaxRefresh is how often hosts are looked up again when there are no
+// TTLs to go by
+const DefaultMaxRefresh = time.Hour
+
+// DefaultVerifyInterval is how often the live rules are checked for drift
+const DefaultVerifyInterval = 5 * time.Minute
+
+// ApplyFunc loads generated rules into the firewall
+type ApplyFunc func(rules []byte) error
+
+// ValidateFunc checks generated rules without applying them
+type ValidateFunc func(rules []byte) error
+
+// VerifyFunc describes how the live rules drifted from the applied rules,
+// nothing is returned when they match
+type VerifyFunc func() ([]string, error)
+
+// Config holds the settings for a Daemon
+type Config struct {
+	RulesPath      string
+	AppVersion     string
+	Options        engine.Options
+	MinRefresh     time.Duration
+	MaxRefresh     time.Duration
+	Apply          ApplyFunc
+	Validate       ValidateFunc
+	Watch          bool
+	WatchInterval  time.Duration
+	Debounce       time.Duration
+	SocketPath     string
+	MetricsAddr    string
+	Families       []iptables.Family
+	LiveRules      LiveRulesFunc
+	Verify         VerifyFunc
+	VerifyInterval time.Duration
+	AutoCorrect    bool
+	// Locked returns true while 'templr panic' has the firewall locked down,
+	// no rules are applied until the lockdown is released
+	Locked func() bool
+}
+
+// Daemon keeps a ruleset in memory and applies it again whenever the
+// addresses of the hosts it looks up change
+type Daemon struct {
+	config   Config
+	ruleset  *engine.RuleSet
+	watched  *engine.RuleSet
+	pending  bool
+	paused   bool
+	status   Status
+	requests chan controlRequest
+	metrics  metrics
+}
+
+// New returns a daemon for the given config
+func New(config Config) *Daemon {
+	if config.MinRefresh <= 0 {
+		config.MinRefresh = DefaultMinRefresh
+	}
+	if config.MaxRefresh < config.MinRefresh {
+		config.MaxRefresh = DefaultMaxRefresh
+	}
+	if config.WatchInterval <= 0 {
+		config.WatchInterval = DefaultWatchInterval
+	}
+	if config.Debounce <= 0 {
+		config.Debounce = DefaultDebounce
+	}
+	if config.VerifyInterval <= 0 {
+		config.VerifyInterval = DefaultVerifyInterval
+	}
+	if len(config.Families) == 0 {
+		config.Families = []iptables.Family{iptables.IPv4, iptables.IPv6}
+	}
+	return &Daemon{config: config, requests: make(chan controlRequest)}
+}
+
+// Run loads and applies the rules, then keeps them up to date with DNS until
+// stop is closed. Only a template that does not load or render stops it from
+// starting, rules that could not be applied are retried.
+func (d *Daemon) Run(stop <-chan struct{}) error {
+	if err := d.load(); err != nil {
+		return err
+	}
+
+	if len(d.config.SocketPath) > 0 {
+		listener, err := listenControl(d.config.SocketPath)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		go serveControl(listener, d.requests, stop)
+		log.Debugf("daemon: listening on %s", d.config.SocketPath)
+	}
+
+	if len(d.config.MetricsAddr) > 0 {
+		server := d.serveMetrics(d.config.MetricsAddr)
+		defer server.Close()
+		log.Infof("Serving metrics on http://%s/metrics", d.config.MetricsAddr)
+	}
+
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+		log.Debugf("daemon: watchdog every %s", interval)
+	}
+	var verify <-chan time.Time
+	if d.config.Verify != nil {
+		ticker := time.NewTicker(d.config.VerifyInterval)
+		defer ticker.Stop()
+		verify = ticker.C
+	}
+
+	sdNotify(notifyReady)
+	defer sdNotify(notifyStopping)
+
+	var watch <-chan time.Time
+	var files *watcher
+	if d.config.Watch {
+		ticker := time.NewTicker(d.config.WatchInterval)
+		defer ticker.Stop()
+		watch = ticker.C
+		files = newWatcher(d.watched.Files(), d.config.Debounce)
+		log.Debugf("daemon: watching %v", d.watched.Files())
+	}
+
+	refreshAt := d.scheduleRefresh()
+	for {
+		timer := time.NewTimer(time.Until(refreshAt))
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			d.refresh()
+			refreshAt = d.scheduleRefresh()
+		case now := <-watch:
+			timer.Stop()
+			if files.check(d.watched.Files(), now) {
+				log.Info("Template files changed, reloading rules")
+				if err := d.reloadTemplate(false); err != nil {
+					log.Errorf("Not applying changed rules: %v", err)
+				}
+				files.reset(d.watched.Files())
+				refreshAt = d.scheduleRefresh()
+			}
+		case <-verify:
+			timer.Stop()
+			d.verify()
+			refreshAt = d.scheduleRefresh()
+		case <-watchdog:
+			// only the loop answers, so a hung apply stops the pings
+			timer.Stop()
+			sdNotify(notifyWatchdog)
+		case request := <-d.requests:
+			timer.Stop()
+			request.reply <- d.handle(request.request)
+			if next := d.scheduleRefresh(); next.Before(refreshAt) {
+				refreshAt = next
+			}
+		}
+	}
+}
+
+// Reload loads the template of a running daemon again and applies it, even
+// when automatic applies are paused
+func (d *Daemon) Reload() error {
+	reply := make(chan Response, 1)
+	d.requests <- controlRequest{Request{CommandReload}, reply}
+	response := <-reply
+	if !response.OK {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+func (d *Daemon) scheduleRefresh() time.Time {
+	wait := d.nextRefresh()
+	log.Debugf("daemon: next refresh in %s", wait)
+	return time.Now().Add(wait)
+}
+
+func (d *Daemon) load() error {
+	ruleset, err := engine.NewRulesetWithOptions(d.config.RulesPath, d.config.Options)
+	if err != nil {
+		return err
+	}
+	d.ruleset = ruleset
+	d.watched = ruleset
+
+	data, err := d.render(ruleset)
+	if err != nil {
+		return err
+	}
+	if err = d.applyRules(data); err != nil {
+		// the loop retries a lockdown or a failed restore, exiting would only
+		// have systemd restart us over and over
+		log.Errorf("%v", err)
+	}
+	return nil
+}
+
+func (d *Daemon) apply() error {
+	data, err := d.render(d.ruleset)
+	if err != nil {
+		d.pending = true
+		return err
+	}
+	return d.applyRules(data)
+}
+
+func (d *Daemon) render(ruleset *engine.RuleSet) ([]byte, error) {
+	start := time.Now()
+	data, err := ruleset.GenerateRules(d.config.AppVersion)
+	if err != nil {
+		d.recordError(err)
+		return nil, err
+	}
+	d.status.RenderedAt = time.Now()
+	d.metrics.rendered(d.status.RenderedAt.Sub(start), data, d.config.Families)
+	return data, nil
+}
+
+func (d *Daemon) applyRules(data []byte) error {
+	if d.locked() {
+		d.pending = true
+		err := errors.New("the firewall is locked down, not applying rules until 'templr panic --release'")
+		d.recordError(err)
+		return err
+	}
+	err := d.config.Apply(data)
+	d.metrics.applied(err)
+	if err != nil {
+		d.pending = true
+		err = errors.Wrapf(err, "apply rules")
+		d.recordError(err)
+		return err
+	}
+	d.pending = false
+	d.status.Drifted = false
+	d.status.AppliedAt = time.Now()
+	d.status.RulesHash = engine.RulesHash(data)
+	sdNotify(sdStatus(fmt.Sprintf("Rules %.12s applied at %s", d.status.RulesHash,
+		d.status.AppliedAt.Format("2006/01/02 15:04:05"))))
+	return nil
+}
+
+// locked returns true while the firewall is locked down
+func (d *Daemon) locked() bool {
+	return d.config.Locked != nil && d.config.Locked()
+}
+
+func (d *Daemon) recordError(err error) {
+	d.status.LastError = err.Error()
+	d.status.ErrorAt = time.Now()
+	sdNotify(sdStatus(fmt.Sprintf("Error: %s", d.status.LastError)))
+}
+
+// refresh looks up the expired hosts again and applies the rules if any of
+// them changed, or if the last apply failed
+func (d *Daemon) refresh() {
+	changes := d.ruleset.Resolver().Refresh()
+	for _, change := range changes {
+		log.Infof("Host %s changed from %v to %v", change.Host, change.Previous, change.Current)
+	}
+	if len(changes) == 0 && !d.pending {
+		log.Debug("daemon: no host changes")
+		return
+	}
+	if d.paused {
+		if len(changes) > 0 {
+			log.Info("Automatic applies are paused, not applying updated rules")
+		}
+		d.pending = true
+		return
+	}
+
+	log.Info("Applying updated firewall rules")
+	if err := d.apply(); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// verify checks the live rules for drift and applies the rules again when
+// auto correct is on
+func (d *Daemon) verify() {
+	drift, err := d.config.Verify()
+	if err != nil {
+		log.Errorf("Could not verify the live rules: %v", err)
+		return
+	}
+	d.status.Drifted = len(drift) > 0
+	if len(drift) == 0 {
+		log.Debug("daemon: live rules match the applied rules")
+		return
+	}
+
+	log.Warn("The live rules drifted from the applied rules")
+	for _, line := range drift {
+		log.Warnf("  %s", line)
+	}
+	if !d.config.AutoCorrect {
+		return
+	}
+	if d.paused {
+		log.Info("Automatic applies are paused, not correcting the drift")
+		return
+	}
+	if d.locked() {
+		log.Info("The firewall is locked down, not correcting the drift")
+		return
+	}
+	log.Info("Applying the rules again to correct the drift")
+	if err = d.apply(); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+func (d *Daemon) nextRefresh() time.Duration {
+	wait := d.config.MaxRefresh
+	if next, found := d.ruleset.Resolver().NextExpiry(); found {
+		wait = time.Until(next)
+	}
+	if (d.pending && !d.paused) || wait < d.config.MinRefresh {
+		wait = d.config.MinRefresh
+	}
+	if wait > d.config.MaxRefresh {
+		wait = d.config.MaxRefresh
+	}
+	return wait
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemonRetriesFailedApply(t *testing.T) {
+	rulesPath := writeTempRules(t, `*filter
+{{ range $addr := lookupIPv4Host "192.0.2.10" -}}
+-A INPUT -s {{ $addr }} -j ACCEPT
+{{ end -}}
+COMMIT
+`)
+	defer os.Remove(rulesPath) // clean up
+
+	applied := [][]byte{}
+	fail := true
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply: func(rules []byte) error {
+			if fail {
+				return errors.New("restore failed")
+			}
+			applied = append(applied, rules)
+			return nil
+		},
+	})
+
+	assert.NoError(t, d.load(), "a failed apply should not stop the daemon")
+	assert.True(t, d.pending, "expected a pending apply")
+	assert.Equal(t, "apply rules: restore failed", d.status.LastError, "error does not match")
+	assert.Equal(t, DefaultMinRefresh, d.nextRefresh(), "failed applies should be retried soon")
+
+	fail = false
+	d.refresh()
+	assert.False(t, d.pending, "unexpected pending apply")
+	assert.Len(t, applied, 1, "expected the rules to be applied")
+	assert.Contains(t, string(applied[0]), "-A INPUT -s 192.0.2.10 -j ACCEPT")
+
+	// nothing changed, so nothing is applied
+	d.refresh()
+	assert.Len(t, applied, 1, "unexpected apply")
+	assert.Equal(t, DefaultMaxRefresh, d.nextRefresh(), "static hosts should wait the longest")
+}
+
+func TestDaemonRefreshLimits(t *testing.T) {
+	d := New(Config{MinRefresh: time.Minute, MaxRefresh: time.Second})
+	assert.Equal(t, time.Minute, d.config.MinRefresh, "unexpected min refresh")
+	assert.Equal(t, DefaultMaxRefresh, d.config.MaxRefresh, "unexpected max refresh")
+}
+
+func TestDaemonCorrectsDrift(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	applied := 0
+	drift := []string{"IPv4 filter INPUT: + 1: -j DROP"}
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply: func(rules []byte) error {
+			applied++
+			return nil
+		},
+		Verify: func() ([]string, error) {
+			return drift, nil
+		},
+	})
+	assert.NoError(t, d.load(), "unexpected error")
+
+	d.verify()
+	assert.True(t, d.status.Drifted, "expected drift")
+	assert.Equal(t, 1, applied, "drift should only be reported")
+
+	d.config.AutoCorrect = true
+	d.verify()
+	assert.False(t, d.status.Drifted, "drift should be corrected")
+	assert.Equal(t, 2, applied, "expected the rules to be applied again")
+
+	drift = []string{}
+	d.verify()
+	assert.Equal(t, 2, applied, "unexpected apply")
+}
+
+func writeTempRules(t *testing.T, rules string) string {
+	file, err := ioutil.TempFile("", "templr-test")
+	if err != nil {
+		t.Fatalf("could not create rules: %v", err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(rules); err != nil {
+		t.Fatalf("could not write rules: %v", err)
+	}
+	return file.Name()
+}
+
+func TestDaemonDoesNotApplyWhileLocked(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	applied := 0
+	locked := true
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply: func(rules []byte) error {
+			applied++
+			return nil
+		},
+		Locked: func() bool { return locked },
+	})
+
+	assert.NoError(t, d.load(), "a lockdown should not stop the daemon")
+	assert.Equal(t, 0, applied, "rules should not be applied while locked down")
+	assert.True(t, d.pending, "expected a pending apply")
+
+	locked = false
+	d.refresh()
+	assert.Equal(t, 1, applied, "rules should be applied once the lockdown is released")
+	assert.False(t, d.pending, "expected no pending apply")
+}
+
+func TestDaemonDoesNotCorrectWhileLocked(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	applied := 0
+	locked := false
+	d := New(Config{
+		RulesPath:   rulesPath,
+		AutoCorrect: true,
+		Apply: func(rules []byte) error {
+			applied++
+			return nil
+		},
+		Verify: func() ([]string, error) {
+			return []string{"IPv4 filter INPUT: - 1: -j ACCEPT"}, nil
+		},
+		Locked: func() bool { return locked },
+	})
+	assert.NoError(t, d.load(), "unexpected error")
+
+	locked = true
+	d.verify()
+	assert.True(t, d.status.Drifted, "expected drift")
+	assert.Equal(t, 1, applied, "the lockdown should not be corrected")
+}
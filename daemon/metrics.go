@@ -0,0 +1,225 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gesquive/templr/engine"
+	"github.com/gesquive/templr/iptables"
+	log "github.com/sirupsen/logrus"
+)
+
+// LiveRulesFunc returns the live rules, with counters, for each ip family
+type LiveRulesFunc func() (map[iptables.Family]*iptables.Rules, error)
+
+// metrics holds what the daemon loop measured, the http server reads it from
+// another goroutine
+type metrics struct {
+	mutex          sync.Mutex
+	lastApply      time.Time
+	applies        uint64
+	applyFailures  uint64
+	renderDuration time.Duration
+	rules          map[iptables.Family]int
+}
+
+func (m *metrics) rendered(duration time.Duration, data []byte, families []iptables.Family) {
+	counts := make(map[iptables.Family]int)
+	for _, family := range families {
+		rules, err := iptables.ParseRules(data, family)
+		if err != nil {
+			continue
+		}
+		for _, table := range rules.Tables {
+			for _, rule := range table.Rules {
+				if rule.Command == "-A" || rule.Command == "-I" {
+					counts[family]++
+				}
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.renderDuration = duration
+	m.rules = counts
+}
+
+func (m *metrics) applied(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		m.applyFailures++
+		return
+	}
+	m.applies++
+	m.lastApply = time.Now()
+}
+
+// serveMetrics exports the metrics in the prometheus text format
+func (d *Daemon) serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics: %v", err)
+		}
+	}()
+	return server
+}
+
+func (d *Daemon) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	d.writeMetrics(&buf)
+
+	if d.config.LiveRules != nil {
+		live, err := d.config.LiveRules()
+		if err != nil {
+			log.Errorf("metrics: %v", err)
+		}
+		writeRuleMetrics(&buf, live)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (d *Daemon) writeMetrics(w io.Writer) {
+	d.metrics.mutex.Lock()
+	defer d.metrics.mutex.Unlock()
+
+	var lastApply float64
+	if !d.metrics.lastApply.IsZero() {
+		lastApply = float64(d.metrics.lastApply.UnixNano()) / 1e9
+	}
+	writeMetricHeader(w, "templr_last_apply_timestamp_seconds", "gauge",
+		"When the rules were last applied successfully")
+	writeMetric(w, "templr_last_apply_timestamp_seconds", lastApply)
+	writeMetricHeader(w, "templr_applies_total", "counter",
+		"How many times the rules were applied")
+	writeMetric(w, "templr_applies_total", float64(d.metrics.applies))
+	writeMetricHeader(w, "templr_apply_failures_total", "counter",
+		"How many times applying the rules failed")
+	writeMetric(w, "templr_apply_failures_total", float64(d.metrics.applyFailures))
+	writeMetricHeader(w, "templr_render_duration_seconds", "gauge",
+		"How long the last render of the template took")
+	writeMetric(w, "templr_render_duration_seconds", d.metrics.renderDuration.Seconds())
+
+	lookups, failures := engine.LookupStats()
+	writeMetricHeader(w, "templr_dns_lookups_total", "counter",
+		"How many host lookups were made")
+	writeMetric(w, "templr_dns_lookups_total", float64(lookups))
+	writeMetricHeader(w, "templr_dns_lookup_failures_total", "counter",
+		"How many host lookups failed")
+	writeMetric(w, "templr_dns_lookup_failures_total", float64(failures))
+
+	writeMetricHeader(w, "templr_rules", "gauge",
+		"How many rules the last render produced for each ip family")
+	for _, family := range d.config.Families {
+		writeMetric(w, "templr_rules", float64(d.metrics.rules[family]), "family", familyLabel(family))
+	}
+}
+
+// writeRuleMetrics writes the counters of the builtin chains and every rule
+func writeRuleMetrics(w io.Writer, live map[iptables.Family]*iptables.Rules) {
+	families := []iptables.Family{}
+	for _, family := range []iptables.Family{iptables.IPv4, iptables.IPv6} {
+		if live[family] != nil {
+			families = append(families, family)
+		}
+	}
+
+	for _, unit := range []string{"packets", "bytes"} {
+		name := "templr_chain_" + unit + "_total"
+		writeMetricHeader(w, name, "counter", "The "+unit+" counted by the policy of each builtin chain")
+		for _, family := range families {
+			for _, table := range live[family].Tables {
+				for _, chain := range table.Chains {
+					if chain.Policy == "-" {
+						continue
+					}
+					writeMetric(w, name, counterValue(&chain.Counters, unit),
+						"family", familyLabel(family), "table", table.Name, "chain", chain.Name)
+				}
+			}
+		}
+	}
+
+	for _, unit := range []string{"packets", "bytes"} {
+		name := "templr_rule_" + unit + "_total"
+		writeMetricHeader(w, name, "counter", "The "+unit+" matched by each rule")
+		for _, family := range families {
+			for _, table := range live[family].Tables {
+				for _, chain := range table.Chains {
+					// the same rule twice in a chain is reported as one
+					ids := []string{}
+					values := make(map[string]float64)
+					comments := make(map[string]string)
+					for _, rule := range table.ChainRules(chain.Name) {
+						if rule.Counters == nil {
+							continue
+						}
+						id := ruleID(rule)
+						if _, seen := values[id]; !seen {
+							ids = append(ids, id)
+							comments[id] = rule.Comment()
+						}
+						values[id] += counterValue(rule.Counters, unit)
+					}
+					for _, id := range ids {
+						writeMetric(w, name, values[id],
+							"family", familyLabel(family), "table", table.Name, "chain", chain.Name,
+							"rule", id, "comment", comments[id])
+					}
+				}
+			}
+		}
+	}
+}
+
+// ruleID identifies a rule by a short hash of its spec, so its series stays
+// the same when rules are added or removed before it
+func ruleID(rule *iptables.Rule) string {
+	spec := strings.Join(append([]string{rule.Chain}, strings.Fields(rule.Spec)...), " ")
+	sum := sha256.Sum256([]byte(spec))
+	return hex.EncodeToString(sum[:6])
+}
+
+func familyLabel(family iptables.Family) string {
+	return strings.ToLower(family.String())
+}
+
+func counterValue(counters *iptables.Counters, unit string) float64 {
+	if unit == "bytes" {
+		return float64(counters.Bytes)
+	}
+	return float64(counters.Packets)
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// writeMetric writes a sample, labels are given as name and value pairs
+func writeMetric(w io.Writer, name string, value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/gesquive/templr/iptables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteRuleMetrics(t *testing.T) {
+	rules, err := iptables.ParseRules([]byte(`*filter
+:INPUT DROP [10:2000]
+:LOGGING - [0:0]
+[4:400] -A INPUT -p tcp --dport 22 -m comment --comment "ssh \"admin\"" -j ACCEPT
+[6:1600] -A INPUT -j LOGGING
+[1:1600] -A INPUT  -j LOGGING
+COMMIT
+`), iptables.IPv4)
+	assert.NoError(t, err, "unexpected error")
+
+	var buf bytes.Buffer
+	writeRuleMetrics(&buf, map[iptables.Family]*iptables.Rules{iptables.IPv4: rules})
+	metrics := buf.String()
+	assert.Contains(t, metrics, "# TYPE templr_chain_packets_total counter\n")
+	assert.Contains(t, metrics, `templr_chain_packets_total{family="ipv4",table="filter",chain="INPUT"} 10`+"\n")
+	assert.Contains(t, metrics, `templr_chain_bytes_total{family="ipv4",table="filter",chain="INPUT"} 2000`+"\n")
+	assert.NotContains(t, metrics, `chain="LOGGING"}`, "user chains have no policy counters")
+	sshID := ruleID(rules.Table("filter").Rules[0])
+	loggingID := ruleID(rules.Table("filter").Rules[1])
+	assert.Len(t, sshID, 12, "unexpected rule id")
+	assert.Contains(t, metrics, `templr_rule_packets_total{family="ipv4",table="filter",chain="INPUT",rule="`+sshID+`",comment="ssh \"admin\""} 4`+"\n")
+	assert.Contains(t, metrics, `templr_rule_bytes_total{family="ipv4",table="filter",chain="INPUT",rule="`+loggingID+`",comment=""} 3200`+"\n")
+}
+
+func TestRuleIDKeepsPosition(t *testing.T) {
+	before, err := iptables.ParseRules([]byte("*filter\n-A INPUT -p tcp --dport 22 -j ACCEPT\nCOMMIT\n"), iptables.IPv4)
+	assert.NoError(t, err, "unexpected error")
+	after, err := iptables.ParseRules([]byte("*filter\n-A INPUT -i lo -j ACCEPT\n-A INPUT -p tcp --dport 22 -j ACCEPT\nCOMMIT\n"), iptables.IPv4)
+	assert.NoError(t, err, "unexpected error")
+
+	assert.Equal(t, ruleID(before.Table("filter").Rules[0]), ruleID(after.Table("filter").Rules[1]),
+		"a rule should keep its id when rules are added before it")
+	assert.NotEqual(t, ruleID(after.Table("filter").Rules[0]), ruleID(after.Table("filter").Rules[1]))
+}
+
+func TestWriteDaemonMetrics(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\n-6 -A INPUT -p ipv6-icmp -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply:     func(rules []byte) error { return nil },
+	})
+	assert.NoError(t, d.load(), "unexpected error")
+
+	var buf bytes.Buffer
+	d.writeMetrics(&buf)
+	metrics := buf.String()
+	assert.Contains(t, metrics, "templr_applies_total 1\n")
+	assert.Contains(t, metrics, "templr_apply_failures_total 0\n")
+	assert.Contains(t, metrics, `templr_rules{family="ipv4"} 1`+"\n")
+	assert.Contains(t, metrics, `templr_rules{family="ipv6"} 2`+"\n")
+	assert.NotContains(t, metrics, "templr_last_apply_timestamp_seconds 0\n", "expected an apply time")
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// the states we report to systemd, see sd_notify(3)
+const (
+	notifyReady     = "READY=1"
+	notifyReloading = "RELOADING=1"
+	notifyStopping  = "STOPPING=1"
+	notifyWatchdog  = "WATCHDOG=1"
+)
+
+// notify sends a state to systemd, nothing is sent when we were not started
+// by systemd with Type=notify
+func notify(states ...string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if len(socketPath) == 0 {
+		return nil
+	}
+	if socketPath[0] == '@' {
+		// an abstract socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrapf(err, "notify systemd")
+	}
+	defer conn.Close()
+
+	message := []byte{}
+	for _, state := range states {
+		message = append(message, state...)
+		message = append(message, '\n')
+	}
+	if _, err = conn.Write(message); err != nil {
+		return errors.Wrapf(err, "notify systemd")
+	}
+	return nil
+}
+
+// sdNotify reports a state to systemd, failures only matter when debugging
+func sdNotify(states ...string) {
+	if err := notify(states...); err != nil {
+		log.Debugf("daemon: %v", err)
+	}
+}
+
+// sdStatus returns a STATUS line for systemd
+func sdStatus(status string) string {
+	return "STATUS=" + status
+}
+
+// watchdogInterval returns how often systemd expects to hear from us, zero is
+// returned when the watchdog is off
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		// the watchdog is meant for another process
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	socketDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(socketDir) // clean up
+	socketPath := path.Join(socketDir, "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	err = notify(notifyReady, sdStatus("Rules applied"))
+	assert.NoError(t, err, "unexpected error")
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "READY=1\nSTATUS=Rules applied\n", string(buf[:n]), "message does not match")
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(t, notify(notifyReady), "unexpected error")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, time.Duration(0), watchdogInterval(), "watchdog should be off")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(t, 30*time.Second, watchdogInterval(), "interval does not match")
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, time.Duration(0), watchdogInterval(), "watchdog is for another process")
+}
@@ -0,0 +1,119 @@
+package daemon
+
+import (
+	"os"
+	"time"
+
+	"github.com/gesquive/templr/engine"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWatchInterval is how often the template files are checked for changes
+const DefaultWatchInterval = time.Second
+
+// DefaultDebounce is how long the template files have to stay unchanged
+// before they are loaded, so a burst of edits only causes one reload
+const DefaultDebounce = 2 * time.Second
+
+// fileStamp is what we compare to tell if a file changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+type fileSnapshot map[string]fileStamp
+
+func takeSnapshot(files []string) fileSnapshot {
+	snapshot := make(fileSnapshot)
+	for _, filePath := range files {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			// a missing file is a change we want to notice too
+			continue
+		}
+		snapshot[filePath] = fileStamp{info.ModTime(), info.Size()}
+	}
+	return snapshot
+}
+
+func (s fileSnapshot) equal(other fileSnapshot) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for filePath, stamp := range s {
+		if otherStamp, ok := other[filePath]; !ok || !stamp.modTime.Equal(otherStamp.modTime) || stamp.size != otherStamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// watcher notices changes to the template files and waits for them to
+// settle before reporting them
+type watcher struct {
+	debounce  time.Duration
+	snapshot  fileSnapshot
+	changedAt time.Time
+}
+
+func newWatcher(files []string, debounce time.Duration) *watcher {
+	return &watcher{debounce: debounce, snapshot: takeSnapshot(files)}
+}
+
+// check returns true once the files changed and have stayed unchanged for
+// the debounce period
+func (w *watcher) check(files []string, now time.Time) bool {
+	snapshot := takeSnapshot(files)
+	if !snapshot.equal(w.snapshot) {
+		w.snapshot = snapshot
+		w.changedAt = now
+		return false
+	}
+	if w.changedAt.IsZero() || now.Sub(w.changedAt) < w.debounce {
+		return false
+	}
+	w.changedAt = time.Time{}
+	return true
+}
+
+// reset starts watching a new set of files without reporting a change
+func (w *watcher) reset(files []string) {
+	w.snapshot = takeSnapshot(files)
+}
+
+// reloadTemplate parses the template again and makes sure iptables accepts
+// the new rules before applying them. While automatic applies are paused the
+// rules are kept for later, unless force is set.
+func (d *Daemon) reloadTemplate(force bool) error {
+	ruleset, err := engine.NewRulesetWithOptions(d.config.RulesPath, d.config.Options)
+	if err != nil {
+		d.recordError(err)
+		return err
+	}
+	d.watched = ruleset
+
+	data, err := d.render(ruleset)
+	if err != nil {
+		return err
+	}
+	if d.config.Validate != nil {
+		if err = d.config.Validate(data); err != nil {
+			err = errors.Wrapf(err, "validation failed")
+			d.recordError(err)
+			return err
+		}
+	}
+
+	d.ruleset = ruleset
+	if d.paused && !force {
+		d.pending = true
+		log.Info("Automatic applies are paused, changed rules will be applied on resume")
+		return nil
+	}
+	if err = d.applyRules(data); err != nil {
+		return err
+	}
+	log.Info("Applied changed rules")
+	return nil
+}
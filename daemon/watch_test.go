@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherDebounce(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	files := []string{rulesPath}
+	start := time.Now()
+	w := newWatcher(files, 2*time.Second)
+	assert.False(t, w.check(files, start), "unexpected change")
+
+	err := ioutil.WriteFile(rulesPath, []byte("*filter\n-A INPUT -j DROP\nCOMMIT\n"), 0644)
+	assert.NoError(t, err, "test file write error")
+
+	assert.False(t, w.check(files, start.Add(time.Second)), "change reported before it settled")
+	assert.False(t, w.check(files, start.Add(2*time.Second)), "change reported before it settled")
+	assert.True(t, w.check(files, start.Add(3*time.Second)), "expected a change")
+	assert.False(t, w.check(files, start.Add(4*time.Second)), "change reported twice")
+}
+
+func TestReloadTemplateValidates(t *testing.T) {
+	rulesPath := writeTempRules(t, "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	defer os.Remove(rulesPath) // clean up
+
+	applied := [][]byte{}
+	valid := true
+	d := New(Config{
+		RulesPath: rulesPath,
+		Apply: func(rules []byte) error {
+			applied = append(applied, rules)
+			return nil
+		},
+		Validate: func(rules []byte) error {
+			if !valid {
+				return errors.New("bad rules")
+			}
+			return nil
+		},
+	})
+	assert.NoError(t, d.load(), "unexpected error")
+	original := d.ruleset
+
+	err := ioutil.WriteFile(rulesPath, []byte("*filter\n-A INPUT -j BOGUS\nCOMMIT\n"), 0644)
+	assert.NoError(t, err, "test file write error")
+	valid = false
+	d.reloadTemplate(false)
+	assert.Len(t, applied, 1, "invalid rules were applied")
+	assert.Equal(t, original, d.ruleset, "ruleset should not change")
+
+	// a broken template is reported, not applied
+	err = ioutil.WriteFile(rulesPath, []byte("*filter\n{{ if }}\nCOMMIT\n"), 0644)
+	assert.NoError(t, err, "test file write error")
+	valid = true
+	d.reloadTemplate(false)
+	assert.Len(t, applied, 1, "broken rules were applied")
+
+	err = ioutil.WriteFile(rulesPath, []byte("*filter\n-A INPUT -j DROP\nCOMMIT\n"), 0644)
+	assert.NoError(t, err, "test file write error")
+	d.reloadTemplate(false)
+	assert.Len(t, applied, 2, "expected the rules to be applied")
+	assert.Contains(t, string(applied[1]), "-A INPUT -j DROP")
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// the address ranges of each class, for both ip families
+var (
+	privateRanges   = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+	loopbackRanges  = []string{"127.0.0.0/8", "::1/128"}
+	linkLocalRanges = []string{"169.254.0.0/16", "fe80::/10"}
+	multicastRanges = []string{"224.0.0.0/4", "ff00::/8"}
+)
+
+// IPFamily returns 4 or 6 for the family of the given address or CIDR range.
+// The family follows how the address is written, so IPv4 mapped IPv6
+// addresses like ::ffff:192.0.2.1 are IPv6.
+func IPFamily(addr string) (int, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.Contains(addr, "/") {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return 0, errors.Errorf("invalid CIDR range '%s'", addr)
+		}
+	} else if net.ParseIP(addr) == nil {
+		return 0, errors.Errorf("invalid address '%s'", addr)
+	}
+
+	if strings.Contains(addr, ":") {
+		return 6, nil
+	}
+	return 4, nil
+}
+
+// IsIPv4Mapped returns true if the given address or CIDR range is an IPv4
+// address written as an IPv6 one, like ::ffff:192.0.2.1
+func IsIPv4Mapped(addr string) bool {
+	family, err := IPFamily(addr)
+	if err != nil || family != 6 {
+		return false
+	}
+	network, err := parseNet(addr)
+	return err == nil && network.IP.To4() != nil
+}
+
+// IPCanonical returns the address in its standard form, IPv6 addresses are
+// compressed and lower case. The host bits of CIDR ranges are cleared.
+func IPCanonical(addr string) (string, error) {
+	family, err := IPFamily(addr)
+	if err != nil {
+		return "", err
+	}
+	network, err := parseNet(addr)
+	if err != nil {
+		return "", err
+	}
+
+	masked := network.IP.Mask(network.Mask)
+	ip := masked.String()
+	size, _ := network.Mask.Size()
+	if family == 6 && masked.To4() != nil {
+		// keep mapped addresses in IPv6 form
+		ip = "::ffff:" + masked.To4().String()
+		if len(network.Mask) == net.IPv4len {
+			size += 96
+		}
+	}
+	if !strings.Contains(addr, "/") {
+		return ip, nil
+	}
+	return ip + "/" + strconv.Itoa(size), nil
+}
+
+// IsPrivate returns true if the given address or CIDR range is in the RFC 1918
+// private IPv4 ranges or the IPv6 unique local range
+func IsPrivate(addr string) bool {
+	return inRanges(addr, privateRanges)
+}
+
+// IsLoopback returns true if the given address or CIDR range is in a
+// loopback range
+func IsLoopback(addr string) bool {
+	return inRanges(addr, loopbackRanges)
+}
+
+// IsLinkLocal returns true if the given address or CIDR range is in a link
+// local unicast range
+func IsLinkLocal(addr string) bool {
+	return inRanges(addr, linkLocalRanges)
+}
+
+// IsMulticast returns true if the given address or CIDR range is in a
+// multicast range
+func IsMulticast(addr string) bool {
+	return inRanges(addr, multicastRanges)
+}
+
+// inRanges returns true if the whole address or CIDR range is inside one of
+// the ranges, invalid addresses are not in any range
+func inRanges(addr string, ranges []string) bool {
+	for _, cidr := range ranges {
+		if contains, err := CIDRContains(cidr, addr); err == nil && contains {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFamily(t *testing.T) {
+	tests := []struct {
+		addr   string
+		family int
+	}{
+		{"192.0.2.1", 4},
+		{"10.0.0.0/8", 4},
+		{"2001:db8::1", 6},
+		{"2001:db8::/32", 6},
+		{"::ffff:192.0.2.1", 6},
+	}
+	for _, test := range tests {
+		family, err := IPFamily(test.addr)
+		assert.NoError(t, err, "unexpected error")
+		assert.Equal(t, test.family, family, "family does not match for %s", test.addr)
+	}
+
+	_, err := IPFamily("rando")
+	assert.Error(t, err, "expected an error")
+	_, err = IPFamily("10.0.0.0/33")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestIsIPv4Mapped(t *testing.T) {
+	assert.True(t, IsIPv4Mapped("::ffff:192.0.2.1"), "unexpected result")
+	assert.True(t, IsIPv4Mapped("::ffff:c000:201"), "unexpected result")
+	assert.False(t, IsIPv4Mapped("192.0.2.1"), "unexpected result")
+	assert.False(t, IsIPv4Mapped("2001:db8::1"), "unexpected result")
+	assert.False(t, IsIPv4Mapped("rando"), "unexpected result")
+}
+
+func TestIPCanonical(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.77/24", "192.0.2.0/24"},
+		{"2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{"::ffff:c000:201", "::ffff:192.0.2.1"},
+		{"::ffff:192.0.2.1/120", "::ffff:192.0.2.0/120"},
+	}
+	for _, test := range tests {
+		result, err := IPCanonical(test.addr)
+		assert.NoError(t, err, "unexpected error")
+		assert.Equal(t, test.expected, result, "canonical form does not match for %s", test.addr)
+	}
+
+	_, err := IPCanonical("rando")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestAddressClasses(t *testing.T) {
+	assert.True(t, IsPrivate("10.1.2.3"), "unexpected result")
+	assert.True(t, IsPrivate("172.20.0.0/16"), "unexpected result")
+	assert.True(t, IsPrivate("fd00::1"), "unexpected result")
+	assert.False(t, IsPrivate("172.0.0.0/8"), "unexpected result")
+	assert.False(t, IsPrivate("8.8.8.8"), "unexpected result")
+
+	assert.True(t, IsLoopback("127.0.0.1"), "unexpected result")
+	assert.True(t, IsLoopback("::1"), "unexpected result")
+	assert.False(t, IsLoopback("10.0.0.1"), "unexpected result")
+
+	assert.True(t, IsLinkLocal("169.254.10.1"), "unexpected result")
+	assert.True(t, IsLinkLocal("fe80::1"), "unexpected result")
+	assert.False(t, IsLinkLocal("ff02::1"), "unexpected result")
+
+	assert.True(t, IsMulticast("224.0.0.251"), "unexpected result")
+	assert.True(t, IsMulticast("ff02::1"), "unexpected result")
+	assert.False(t, IsMulticast("rando"), "unexpected result")
+}
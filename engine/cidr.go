@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSubnets limits how many subnets CIDRSubnets returns, so a typo does not
+// generate millions of rules
+const maxSubnets = 65536
+
+// CIDRContains returns true if the CIDR range contains the given address or
+// the whole of the given CIDR range
+func CIDRContains(cidr string, addr string) (bool, error) {
+	outer, err := parseCIDR(cidr)
+	if err != nil {
+		return false, err
+	}
+	inner, err := parseNet(addr)
+	if err != nil {
+		return false, err
+	}
+	if len(outer.IP) != len(inner.IP) {
+		return false, nil
+	}
+	outerSize, _ := outer.Mask.Size()
+	innerSize, _ := inner.Mask.Size()
+	return outer.Contains(inner.IP) && innerSize >= outerSize, nil
+}
+
+// CIDRNetwork returns the first address of the CIDR range
+func CIDRNetwork(cidr string) (string, error) {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	return network.IP.String(), nil
+}
+
+// CIDRBroadcast returns the last address of the CIDR range, for IPv6 ranges
+// too even though IPv6 has no broadcast address
+func CIDRBroadcast(cidr string) (string, error) {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	r := netRange(network)
+	return intToIP(r.end, r.bits).String(), nil
+}
+
+// CIDRHost returns the address with the given number in the CIDR range,
+// negative numbers count back from the last address
+func CIDRHost(num int, cidr string) (string, error) {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	r := netRange(network)
+	host := new(big.Int)
+	if num < 0 {
+		host.Add(r.end, big.NewInt(int64(num+1)))
+	} else {
+		host.Add(r.start, big.NewInt(int64(num)))
+	}
+	if host.Cmp(r.start) < 0 || host.Cmp(r.end) > 0 {
+		return "", errors.Errorf("host %d is outside of '%s'", num, cidr)
+	}
+	return intToIP(host, r.bits).String(), nil
+}
+
+// CIDRSubnets splits the CIDR range into subnets with the given prefix length
+func CIDRSubnets(prefix int, cidr string) ([]string, error) {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	size, bits := network.Mask.Size()
+	if prefix < size || prefix > bits {
+		return nil, errors.Errorf("cannot split '%s' into /%d subnets", cidr, prefix)
+	}
+	if prefix-size > 16 {
+		return nil, errors.Errorf("splitting '%s' into /%d subnets makes more than %d subnets",
+			cidr, prefix, maxSubnets)
+	}
+
+	r := netRange(network)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefix))
+	subnets := []string{}
+	for start := r.start; start.Cmp(r.end) <= 0; start = new(big.Int).Add(start, step) {
+		subnet := net.IPNet{IP: intToIP(start, bits), Mask: net.CIDRMask(prefix, bits)}
+		subnets = append(subnets, subnet.String())
+	}
+	return subnets, nil
+}
+
+// CIDROverlaps returns true if the two addresses or CIDR ranges share any
+// address
+func CIDROverlaps(a string, b string) (bool, error) {
+	first, err := parseNet(a)
+	if err != nil {
+		return false, err
+	}
+	second, err := parseNet(b)
+	if err != nil {
+		return false, err
+	}
+	return first.Contains(second.IP) || second.Contains(first.IP), nil
+}
+
+// CIDRMerge collapses the given addresses, CIDR ranges and ip ranges into the
+// fewest CIDR ranges that cover the same addresses. IPv4 ranges come first,
+// then IPv6. Arguments can be strings or lists of strings.
+func CIDRMerge(items ...interface{}) ([]string, error) {
+	addrs, err := flattenStrings(items)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := []ipRange{}
+	for _, addr := range addrs {
+		if strings.Contains(addr, "-") {
+			r, err := ParseIPRange(addr)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r.span())
+			continue
+		}
+		network, err := parseNet(addr)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, netRange(network))
+	}
+
+	merged := []string{}
+	for _, r := range mergeRanges(ranges) {
+		merged = append(merged, r.cidrs()...)
+	}
+	return merged, nil
+}
+
+// ipRange is an inclusive range of addresses in a single ip family
+type ipRange struct {
+	start *big.Int
+	end   *big.Int
+	bits  int
+}
+
+// cidrs returns the fewest CIDR ranges that cover the range
+func (r ipRange) cidrs() []string {
+	cidrs := []string{}
+	one := big.NewInt(1)
+	start := new(big.Int).Set(r.start)
+	for start.Cmp(r.end) <= 0 {
+		// grow the block while it stays aligned and inside the range
+		size := 0
+		for size < r.bits {
+			next := size + 1
+			if start.Bit(size) != 0 {
+				break
+			}
+			last := new(big.Int).Lsh(one, uint(next))
+			last.Add(last, start).Sub(last, one)
+			if last.Cmp(r.end) > 0 {
+				break
+			}
+			size = next
+		}
+		block := net.IPNet{IP: intToIP(start, r.bits), Mask: net.CIDRMask(r.bits-size, r.bits)}
+		cidrs = append(cidrs, block.String())
+		start.Add(start, new(big.Int).Lsh(one, uint(size)))
+	}
+	return cidrs
+}
+
+// mergeRanges sorts the ranges and joins the ones that overlap or touch
+func mergeRanges(ranges []ipRange) []ipRange {
+	sorted := make([]ipRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bits != sorted[j].bits {
+			return sorted[i].bits < sorted[j].bits
+		}
+		return sorted[i].start.Cmp(sorted[j].start) < 0
+	})
+
+	merged := []ipRange{}
+	for _, r := range sorted {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			next := new(big.Int).Add(last.end, big.NewInt(1))
+			if last.bits == r.bits && r.start.Cmp(next) <= 0 {
+				if r.end.Cmp(last.end) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, ipRange{r.start, r.end, r.bits})
+	}
+	return merged
+}
+
+// netRange returns the addresses of the network as a range
+func netRange(network *net.IPNet) ipRange {
+	bits := len(network.IP) * 8
+	start := ipToInt(network.IP.Mask(network.Mask))
+	size, _ := network.Mask.Size()
+	end := new(big.Int).Lsh(big.NewInt(1), uint(bits-size))
+	end.Sub(end, big.NewInt(1)).Add(end, start)
+	return ipRange{start, end, bits}
+}
+
+// parseCIDR parses a CIDR range, IPv4 addresses are kept 4 bytes long
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, errors.Errorf("invalid CIDR range '%s'", cidr)
+	}
+	if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		network.IP = ip4
+	}
+	return network, nil
+}
+
+// parseNet parses a CIDR range or a single address, which is treated as a
+// range of one
+func parseNet(addr string) (*net.IPNet, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.Contains(addr, "/") {
+		return parseCIDR(addr)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.Errorf("invalid address '%s'", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(i *big.Int, bits int) net.IP {
+	ip := make(net.IP, bits/8)
+	b := i.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// flattenStrings turns template arguments that are strings or lists of
+// strings into a single list
+func flattenStrings(items []interface{}) ([]string, error) {
+	flat := []string{}
+	for _, item := range items {
+		switch value := item.(type) {
+		case string:
+			flat = append(flat, value)
+		case []string:
+			flat = append(flat, value...)
+		case []interface{}:
+			values, err := flattenStrings(value)
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, values...)
+		default:
+			return nil, errors.Errorf("expected a string or a list, got %T", item)
+		}
+	}
+	return flat, nil
+}
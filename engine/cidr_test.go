@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCIDRContains(t *testing.T) {
+	tests := []struct {
+		cidr     string
+		addr     string
+		expected bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"10.0.0.0/8", "10.20.0.0/16", true},
+		{"10.20.0.0/16", "10.0.0.0/8", false},
+		{"10.0.0.0/8", "::1", false},
+		{"2001:db8::/32", "2001:db8:1::1", true},
+	}
+	for _, test := range tests {
+		result, err := CIDRContains(test.cidr, test.addr)
+		assert.NoError(t, err, "unexpected error")
+		assert.Equal(t, test.expected, result, "unexpected result for %s in %s", test.addr, test.cidr)
+	}
+
+	_, err := CIDRContains("10.0.0.1", "10.0.0.1")
+	assert.Error(t, err, "expected an error")
+	_, err = CIDRContains("10.0.0.0/8", "rando")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestCIDRNetworkAndBroadcast(t *testing.T) {
+	network, err := CIDRNetwork("192.168.1.77/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "192.168.1.0", network, "network does not match")
+
+	broadcast, err := CIDRBroadcast("192.168.1.77/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "192.168.1.255", broadcast, "broadcast does not match")
+
+	broadcast, err = CIDRBroadcast("2001:db8::/64")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "2001:db8::ffff:ffff:ffff:ffff", broadcast, "broadcast does not match")
+}
+
+func TestCIDRHost(t *testing.T) {
+	host, err := CIDRHost(5, "10.0.0.0/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "10.0.0.5", host, "host does not match")
+
+	host, err = CIDRHost(-2, "10.0.0.0/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "10.0.0.254", host, "host does not match")
+
+	host, err = CIDRHost(1, "2001:db8::/64")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "2001:db8::1", host, "host does not match")
+
+	_, err = CIDRHost(256, "10.0.0.0/24")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestCIDRSubnets(t *testing.T) {
+	subnets, err := CIDRSubnets(26, "10.0.0.0/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"},
+		subnets, "subnets do not match")
+
+	subnets, err = CIDRSubnets(49, "2001:db8::/48")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"2001:db8::/49", "2001:db8:0:8000::/49"}, subnets, "subnets do not match")
+
+	_, err = CIDRSubnets(16, "10.0.0.0/24")
+	assert.Error(t, err, "expected an error")
+	_, err = CIDRSubnets(32, "10.0.0.0/8")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestCIDROverlaps(t *testing.T) {
+	result, err := CIDROverlaps("10.0.0.0/8", "10.20.0.0/16")
+	assert.NoError(t, err, "unexpected error")
+	assert.True(t, result, "unexpected result")
+
+	result, err = CIDROverlaps("10.0.0.0/24", "10.0.1.0/24")
+	assert.NoError(t, err, "unexpected error")
+	assert.False(t, result, "unexpected result")
+
+	result, err = CIDROverlaps("10.0.0.5", "10.0.0.0/29")
+	assert.NoError(t, err, "unexpected error")
+	assert.True(t, result, "unexpected result")
+}
+
+func TestCIDRMerge(t *testing.T) {
+	merged, err := CIDRMerge([]interface{}{"10.0.0.0", "10.0.0.1", "10.0.0.2/31"},
+		"2001:db8::1", []string{"2001:db8::/127", "10.0.0.4/30", "192.168.0.1", "10.0.0.9"})
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.0.0.0/29", "10.0.0.9/32", "192.168.0.1/32", "2001:db8::/127"},
+		merged, "merged ranges do not match")
+
+	merged, err = CIDRMerge("10.0.0.1", "10.0.0.2", "10.0.0.0/8")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.0.0.0/8"}, merged, "merged ranges do not match")
+
+	_, err = CIDRMerge("10.0.0.1", 5)
+	assert.Error(t, err, "expected an error")
+}
@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCloudCacheTTL is how long downloaded cloud ip ranges are used before
+// they are downloaded again
+const DefaultCloudCacheTTL = 24 * time.Hour
+
+// CloudRangeURLs are where the published ip ranges of each cloud provider are
+// downloaded from. Azure moves its service tags file every week, so it has to
+// be configured.
+var CloudRangeURLs = map[string]string{
+	"aws": "https://ip-ranges.amazonaws.com/ip-ranges.json",
+	"gcp": "https://www.gstatic.com/ipranges/cloud.json",
+}
+
+var cloudClient = &http.Client{Timeout: 30 * time.Second}
+
+// cloudPrefix is a published prefix along with what it is used for
+type cloudPrefix struct {
+	prefix  string
+	service []string
+	region  string
+}
+
+type cloudDocument struct {
+	source   string
+	modTime  time.Time
+	loaded   time.Time
+	prefixes []cloudPrefix
+}
+
+// AWSRanges returns the CIDR ranges AWS publishes for the service, like
+// "S3" or "EC2", in the region, like "us-east-1". Empty arguments match
+// everything. IPv4 ranges come first, then IPv6.
+func (r *RuleSet) AWSRanges(service string, region string) ([]string, error) {
+	return r.cloudRanges("aws", service, region)
+}
+
+// GCPRanges returns the CIDR ranges Google Cloud publishes for the service,
+// like "Google Cloud", in the scope, like "us-central1"
+func (r *RuleSet) GCPRanges(service string, scope string) ([]string, error) {
+	return r.cloudRanges("gcp", service, scope)
+}
+
+// AzureRanges returns the CIDR ranges of the Azure service tag, like
+// "Storage" or "AzureCloud", in the region, like "westeurope"
+func (r *RuleSet) AzureRanges(tag string, region string) ([]string, error) {
+	return r.cloudRanges("azure", tag, region)
+}
+
+func (r *RuleSet) cloudRanges(provider string, service string, region string) ([]string, error) {
+	doc, err := r.cloudDocument(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := []string{}
+	ipv6 := []string{}
+	seen := make(map[string]bool)
+	for _, prefix := range doc.prefixes {
+		if !prefix.matches(service, region) || seen[prefix.prefix] {
+			continue
+		}
+		seen[prefix.prefix] = true
+		if family, _ := IPFamily(prefix.prefix); family == 4 {
+			ipv4 = append(ipv4, prefix.prefix)
+		} else {
+			ipv6 = append(ipv6, prefix.prefix)
+		}
+	}
+	return append(ipv4, ipv6...), nil
+}
+
+func (p cloudPrefix) matches(service string, region string) bool {
+	if len(region) > 0 && !strings.EqualFold(p.region, region) {
+		return false
+	}
+	if len(service) == 0 {
+		return true
+	}
+	for _, name := range p.service {
+		if strings.EqualFold(name, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudDocument returns the parsed ip ranges of the provider. Files are read
+// again when they change, downloads when they are older than the cache TTL.
+func (r *RuleSet) cloudDocument(provider string) (*cloudDocument, error) {
+	source := r.options.CloudRanges[provider]
+	if len(source) == 0 {
+		source = CloudRangeURLs[provider]
+	}
+	if len(source) == 0 {
+		return nil, errors.Errorf("no source set for %s ip ranges", provider)
+	}
+	download := strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+
+	var data []byte
+	var modTime time.Time
+	var err error
+	if download {
+		if doc, ok := r.clouds[provider]; ok && doc.source == source &&
+			time.Since(doc.loaded) < r.cloudCacheTTL() {
+			return doc, nil
+		}
+		data, err = r.downloadRanges(provider, source)
+	} else {
+		filePath := r.dataPath(source)
+		info, statErr := os.Stat(filePath)
+		if statErr == nil {
+			modTime = info.ModTime()
+			if doc, ok := r.clouds[provider]; ok && doc.source == source && doc.modTime.Equal(modTime) {
+				return doc, nil
+			}
+		}
+		data, err = ioutil.ReadFile(filePath)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s ip ranges", provider)
+	}
+
+	prefixes, err := parseCloudRanges(provider, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s ip ranges from %s", provider, source)
+	}
+	doc := &cloudDocument{source: source, modTime: modTime, loaded: time.Now(), prefixes: prefixes}
+	if r.clouds == nil {
+		r.clouds = make(map[string]*cloudDocument)
+	}
+	r.clouds[provider] = doc
+	return doc, nil
+}
+
+// downloadRanges downloads the ranges of the provider, keeping a copy in the
+// cache dir. The copy is used until the cache TTL runs out, and when the
+// download fails. The cache is only a help, failing to write it is not an
+// error.
+func (r *RuleSet) downloadRanges(provider string, url string) ([]byte, error) {
+	cachePath := ""
+	if len(r.options.CacheDir) > 0 {
+		cachePath = cloudCachePath(r.options.CacheDir, provider, url)
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < r.cloudCacheTTL() {
+			if cached, err := readCachedRanges(provider, cachePath); err == nil {
+				return cached, nil
+			}
+			log.Warnf("The cached %s ip ranges are unreadable, downloading them again", provider)
+		}
+	}
+
+	data, err := fetchRanges(url)
+	if err == nil {
+		if _, err = parseCloudRanges(provider, data); err != nil {
+			err = errors.Wrapf(err, "parse %s", url)
+		}
+	}
+	if err != nil {
+		if len(cachePath) > 0 {
+			if cached, cacheErr := readCachedRanges(provider, cachePath); cacheErr == nil {
+				log.Warnf("Could not download the %s ip ranges, using the expired cached copy: %v", provider, err)
+				return cached, nil
+			}
+		}
+		return nil, err
+	}
+
+	if len(cachePath) > 0 {
+		err = os.MkdirAll(r.options.CacheDir, 0750)
+		if err == nil {
+			err = ioutil.WriteFile(cachePath, data, 0640)
+		}
+		if err != nil {
+			log.Warnf("Could not cache the %s ip ranges: %v", provider, err)
+		}
+	}
+	return data, nil
+}
+
+// cloudCachePath returns where the ranges downloaded from the url are cached,
+// so changing the url does not pick up the copy of the old one
+func cloudCachePath(cacheDir string, provider string, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return path.Join(cacheDir, provider+"-"+hex.EncodeToString(sum[:6])+"-ip-ranges.json")
+}
+
+// readCachedRanges reads a cached copy, as long as it still parses
+func readCachedRanges(provider string, cachePath string) ([]byte, error) {
+	data, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parseCloudRanges(provider, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func fetchRanges(url string) ([]byte, error) {
+	response, err := cloudClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("download %s: %s", url, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+func (r *RuleSet) cloudCacheTTL() time.Duration {
+	if r.options.CacheTTL > 0 {
+		return r.options.CacheTTL
+	}
+	return DefaultCloudCacheTTL
+}
+
+// parseCloudRanges reads the prefixes out of the format the provider
+// publishes
+func parseCloudRanges(provider string, data []byte) ([]cloudPrefix, error) {
+	prefixes := []cloudPrefix{}
+	switch provider {
+	case "aws":
+		var doc struct {
+			Prefixes []struct {
+				Prefix  string `json:"ip_prefix"`
+				Region  string `json:"region"`
+				Service string `json:"service"`
+			} `json:"prefixes"`
+			IPv6Prefixes []struct {
+				Prefix  string `json:"ipv6_prefix"`
+				Region  string `json:"region"`
+				Service string `json:"service"`
+			} `json:"ipv6_prefixes"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, p := range doc.Prefixes {
+			prefixes = append(prefixes, cloudPrefix{p.Prefix, []string{p.Service}, p.Region})
+		}
+		for _, p := range doc.IPv6Prefixes {
+			prefixes = append(prefixes, cloudPrefix{p.Prefix, []string{p.Service}, p.Region})
+		}
+	case "gcp":
+		var doc struct {
+			Prefixes []struct {
+				IPv4Prefix string `json:"ipv4Prefix"`
+				IPv6Prefix string `json:"ipv6Prefix"`
+				Service    string `json:"service"`
+				Scope      string `json:"scope"`
+			} `json:"prefixes"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, p := range doc.Prefixes {
+			prefix := p.IPv4Prefix
+			if len(prefix) == 0 {
+				prefix = p.IPv6Prefix
+			}
+			prefixes = append(prefixes, cloudPrefix{prefix, []string{p.Service}, p.Scope})
+		}
+	case "azure":
+		var doc struct {
+			Values []struct {
+				Name       string `json:"name"`
+				Properties struct {
+					Region          string   `json:"region"`
+					SystemService   string   `json:"systemService"`
+					AddressPrefixes []string `json:"addressPrefixes"`
+				} `json:"properties"`
+			} `json:"values"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		for _, v := range doc.Values {
+			// regional tags are named like Storage.WestEurope
+			services := []string{v.Name, strings.SplitN(v.Name, ".", 2)[0]}
+			if len(v.Properties.SystemService) > 0 {
+				services = append(services, v.Properties.SystemService)
+			}
+			for _, prefix := range v.Properties.AddressPrefixes {
+				prefixes = append(prefixes, cloudPrefix{prefix, services, v.Properties.Region})
+			}
+		}
+	default:
+		return nil, errors.Errorf("unknown cloud provider '%s'", provider)
+	}
+
+	for i, p := range prefixes {
+		canonical, err := IPCanonical(p.prefix)
+		if err != nil {
+			return nil, errors.Errorf("prefix %d: %v", i+1, err)
+		}
+		prefixes[i].prefix = canonical
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no prefixes found")
+	}
+	return prefixes, nil
+}
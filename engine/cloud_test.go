@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAWSRanges = `{
+  "syncToken": "1700000000",
+  "prefixes": [
+    {"ip_prefix": "3.5.0.0/19", "region": "us-east-1", "service": "AMAZON", "network_border_group": "us-east-1"},
+    {"ip_prefix": "3.5.0.0/19", "region": "us-east-1", "service": "S3", "network_border_group": "us-east-1"},
+    {"ip_prefix": "52.94.0.0/22", "region": "eu-west-1", "service": "S3", "network_border_group": "eu-west-1"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:1F18::/33", "region": "us-east-1", "service": "S3", "network_border_group": "us-east-1"}
+  ]
+}`
+
+const testGCPRanges = `{
+  "prefixes": [
+    {"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud", "scope": "us-central1"},
+    {"ipv6Prefix": "2600:1900:4000::/44", "service": "Google Cloud", "scope": "us-central1"},
+    {"ipv4Prefix": "34.35.0.0/16", "service": "Google Cloud", "scope": "europe-west1"}
+  ]
+}`
+
+const testAzureRanges = `{
+  "values": [
+    {"name": "Storage", "properties": {"region": "", "systemService": "AzureStorage",
+      "addressPrefixes": ["13.65.0.0/16", "20.38.96.0/19", "2603:1030::/45"]}},
+    {"name": "Storage.WestEurope", "properties": {"region": "westeurope", "systemService": "AzureStorage",
+      "addressPrefixes": ["20.38.96.0/19", "2603:1030::/45"]}}
+  ]
+}`
+
+func TestCloudRangesFromFiles(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	for name, contents := range map[string]string{
+		"aws.json":   testAWSRanges,
+		"gcp.json":   testGCPRanges,
+		"azure.json": testAzureRanges,
+	} {
+		err = ioutil.WriteFile(path.Join(dirPath, name), []byte(contents), 0644)
+		assert.NoError(t, err, "test file write error")
+	}
+
+	ruleset := &RuleSet{
+		templatePath: path.Join(dirPath, "rules.tr"),
+		options: Options{CloudRanges: map[string]string{
+			"aws":   "aws.json",
+			"gcp":   "gcp.json",
+			"azure": "azure.json",
+		}},
+	}
+
+	ranges, err := ruleset.AWSRanges("s3", "us-east-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"3.5.0.0/19", "2600:1f18::/33"}, ranges, "aws ranges do not match")
+
+	ranges, err = ruleset.AWSRanges("", "")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"3.5.0.0/19", "52.94.0.0/22", "2600:1f18::/33"}, ranges, "aws ranges do not match")
+
+	ranges, err = ruleset.GCPRanges("Google Cloud", "us-central1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"34.1.208.0/20", "2600:1900:4000::/44"}, ranges, "gcp ranges do not match")
+
+	ranges, err = ruleset.AzureRanges("Storage", "WestEurope")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"20.38.96.0/19", "2603:1030::/45"}, ranges, "azure ranges do not match")
+
+	ranges, err = ruleset.AzureRanges("AzureStorage", "")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"13.65.0.0/16", "20.38.96.0/19", "2603:1030::/45"}, ranges, "azure ranges do not match")
+
+	ranges, err = ruleset.AWSRanges("EC2", "")
+	assert.NoError(t, err, "unexpected error")
+	assert.Empty(t, ranges, "expected no ranges")
+
+	assert.Contains(t, ruleset.Files(), path.Join(dirPath, "aws.json"), "range files should be watched")
+}
+
+func TestCloudRangesDownload(t *testing.T) {
+	requests := 0
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(testAWSRanges))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(cacheDir) // clean up
+
+	options := Options{
+		CloudRanges: map[string]string{"aws": server.URL + "/ip-ranges.json"},
+		CacheDir:    path.Join(cacheDir, "cloud"),
+		CacheTTL:    time.Hour,
+	}
+	ruleset := &RuleSet{templatePath: "rules.tr", options: options}
+	ranges, err := ruleset.AWSRanges("S3", "eu-west-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"52.94.0.0/22"}, ranges, "aws ranges do not match")
+	_, err = ruleset.AWSRanges("S3", "us-east-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, 1, requests, "expected a single download")
+
+	// a new ruleset uses the cached copy
+	ruleset = &RuleSet{templatePath: "rules.tr", options: options}
+	_, err = ruleset.AWSRanges("S3", "")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, 1, requests, "expected the cached copy to be used")
+
+	// an expired copy is still used when the download fails
+	old := time.Now().Add(-2 * time.Hour)
+	cachePath := cloudCachePath(options.CacheDir, "aws", options.CloudRanges["aws"])
+	os.Chtimes(cachePath, old, old)
+	fail = true
+	ruleset = &RuleSet{templatePath: "rules.tr", options: options}
+	ranges, err = ruleset.AWSRanges("S3", "eu-west-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"52.94.0.0/22"}, ranges, "aws ranges do not match")
+	assert.Equal(t, 2, requests, "expected a new download")
+
+	// a copy from another url is not used
+	options.CloudRanges["aws"] = server.URL + "/other.json"
+	ruleset = &RuleSet{templatePath: "rules.tr", options: options}
+	_, err = ruleset.AWSRanges("S3", "")
+	assert.Error(t, err, "expected an error")
+	assert.Equal(t, 3, requests, "expected a new download")
+
+	options.CacheDir = ""
+	ruleset = &RuleSet{templatePath: "rules.tr", options: options}
+	_, err = ruleset.AWSRanges("S3", "")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestCloudRangesCache(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(testAWSRanges))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(cacheDir) // clean up
+
+	url := server.URL + "/ip-ranges.json"
+	options := Options{
+		CloudRanges: map[string]string{"aws": url},
+		CacheDir:    cacheDir,
+		CacheTTL:    time.Hour,
+	}
+
+	// a cached copy that does not parse is downloaded again
+	cachePath := cloudCachePath(cacheDir, "aws", url)
+	err = ioutil.WriteFile(cachePath, []byte(`{"prefixes": [`), 0640)
+	assert.NoError(t, err, "test file write error")
+	ruleset := &RuleSet{templatePath: "rules.tr", options: options}
+	ranges, err := ruleset.AWSRanges("S3", "eu-west-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"52.94.0.0/22"}, ranges, "aws ranges do not match")
+	assert.Equal(t, 1, requests, "expected a new download")
+	cached, err := ioutil.ReadFile(cachePath)
+	assert.NoError(t, err, "expected a cached copy")
+	assert.Equal(t, testAWSRanges, string(cached), "cached copy does not match")
+
+	// the ranges are still used when the cache cannot be written
+	blocked := path.Join(cacheDir, "blocked")
+	err = ioutil.WriteFile(blocked, []byte{}, 0640)
+	assert.NoError(t, err, "test file write error")
+	options.CacheDir = path.Join(blocked, "cloud")
+	ruleset = &RuleSet{templatePath: "rules.tr", options: options}
+	ranges, err = ruleset.AWSRanges("S3", "eu-west-1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"52.94.0.0/22"}, ranges, "aws ranges do not match")
+	assert.Equal(t, 2, requests, "expected a new download")
+}
+
+func TestCloudRangesErrors(t *testing.T) {
+	ruleset := &RuleSet{templatePath: "rules.tr"}
+	_, err := ruleset.AzureRanges("Storage", "")
+	assert.EqualError(t, err, "no source set for azure ip ranges", "error does not match")
+
+	_, err = parseCloudRanges("aws", []byte(`{"prefixes": [{"ip_prefix": "3.5.0.0/33"}]}`))
+	assert.Error(t, err, "expected an error")
+
+	_, err = parseCloudRanges("gcp", []byte(`{}`))
+	assert.Error(t, err, "expected an error")
+
+	_, err = parseCloudRanges("azure", []byte(`[`))
+	assert.Error(t, err, "expected an error")
+}
@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// LoadYAML reads a yaml file relative to the template, the data is the same
+// as a {$ $} block would give
+func (r *RuleSet) LoadYAML(dataPath string) (interface{}, error) {
+	dataBytes, err := ioutil.ReadFile(r.dataPath(dataPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load yaml")
+	}
+	var data interface{}
+	if err = yaml.Unmarshal(dataBytes, &data); err != nil {
+		return nil, errors.Wrapf(err, "load yaml %s", dataPath)
+	}
+	return data, nil
+}
+
+// LoadJSON reads a json file relative to the template
+func (r *RuleSet) LoadJSON(dataPath string) (interface{}, error) {
+	dataBytes, err := ioutil.ReadFile(r.dataPath(dataPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load json")
+	}
+	var data interface{}
+	if err = json.Unmarshal(dataBytes, &data); err != nil {
+		return nil, errors.Wrapf(err, "load json %s", dataPath)
+	}
+	return data, nil
+}
+
+// LoadCSV reads a csv file relative to the template and returns a row for
+// each line, keyed by the column names in the first line. Lines starting
+// with # are comments.
+func (r *RuleSet) LoadCSV(dataPath string) ([]map[string]string, error) {
+	file, err := os.Open(r.dataPath(dataPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "load csv")
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []map[string]string{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "load csv %s", dataPath)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	rows := []map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "load csv %s", dataPath)
+		}
+		row := make(map[string]string)
+		for i, column := range header {
+			row[column] = strings.TrimSpace(record[i])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadData(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	files := map[string]string{
+		"rules.tr": `{{ range (loadYAML "data/services.yml").services }}{{ .name }}:{{ index .ports 0 }}
+{{ end }}{{ range (loadJSON "data/services.json").services }}{{ .name }}:{{ index .ports 0 }}
+{{ end }}{{ range loadCSV "data/services.csv" }}{{ .name }}:{{ .port }}
+{{ end }}`,
+		"data/services.yml":  "services:\n  - name: ssh\n    ports: [22]\n",
+		"data/services.json": `{"services": [{"name": "https", "ports": [443, 8443]}]}`,
+		"data/services.csv":  "# service matrix\nname, port\ndns, 53\nntp, \"123\"\n",
+	}
+	err = os.Mkdir(path.Join(dirPath, "data"), 0755)
+	assert.NoError(t, err, "failed to make dir")
+	for name, contents := range files {
+		err = ioutil.WriteFile(path.Join(dirPath, name), []byte(contents), 0644)
+		assert.NoError(t, err, "test file write error")
+	}
+
+	rulesFilePath := path.Join(dirPath, "rules.tr")
+	ruleset, err := NewRuleset(rulesFilePath)
+	assert.NoError(t, err, "unexpected error")
+	rules, err := ruleset.GenerateRules("test")
+	assert.NoError(t, err, "unexpected error")
+	assert.Contains(t, string(rules), "ssh:22\nhttps:443\ndns:53\nntp:123\n", "rules do not match")
+
+	assert.Equal(t, []string{
+		rulesFilePath,
+		path.Join(dirPath, "data/services.yml"),
+		path.Join(dirPath, "data/services.json"),
+		path.Join(dirPath, "data/services.csv"),
+	}, ruleset.Files(), "files do not match")
+}
+
+func TestLoadDataErrors(t *testing.T) {
+	ruleset := &RuleSet{templatePath: "rules.tr"}
+
+	badJSON, err := writeTempFile([]byte(`{"services": [}`))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(badJSON) // clean up
+	_, err = ruleset.LoadJSON(badJSON)
+	assert.Error(t, err, "expected an error")
+
+	badYAML, err := writeTempFile([]byte("services: [ssh\n"))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(badYAML) // clean up
+	_, err = ruleset.LoadYAML(badYAML)
+	assert.Error(t, err, "expected an error")
+
+	badCSV, err := writeTempFile([]byte("name,port\nssh\n"))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(badCSV) // clean up
+	_, err = ruleset.LoadCSV(badCSV)
+	assert.Error(t, err, "expected an error")
+
+	emptyCSV, err := writeTempFile([]byte(""))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(emptyCSV) // clean up
+	rows, err := ruleset.LoadCSV(emptyCSV)
+	assert.NoError(t, err, "unexpected error")
+	assert.Empty(t, rows, "expected no rows")
+
+	_, err = ruleset.LoadYAML("missing.yml")
+	assert.Error(t, err, "expected an error")
+}
@@ -0,0 +1,303 @@
+package engine
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The go resolver does not report TTLs, so we talk to the name servers from
+// resolv.conf ourselves for the record types the template functions need.
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeCNAME uint16 = 5
+	dnsTypePTR   uint16 = 12
+	dnsTypeMX    uint16 = 15
+	dnsTypeTXT   uint16 = 16
+	dnsTypeAAAA  uint16 = 28
+	dnsTypeSRV   uint16 = 33
+
+	dnsClassIN uint16 = 1
+
+	dnsRcodeNameError = 3
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+var errDNSNotFound = errors.New("no such host")
+
+// dnsAnswer is a single resource record from the answer section
+type dnsAnswer struct {
+	Name     string
+	Type     uint16
+	TTL      uint32
+	Value    string
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+}
+
+type dnsClient struct {
+	servers []string
+	timeout time.Duration
+}
+
+// newDNSClient returns a client that queries the name servers in resolv.conf
+func newDNSClient() *dnsClient {
+	client := &dnsClient{timeout: 2 * time.Second}
+
+	if file, err := os.Open(resolvConfPath); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			server := fields[1]
+			if i := strings.IndexByte(server, '%'); i >= 0 {
+				server = server[:i]
+			}
+			if net.ParseIP(server) != nil {
+				client.servers = append(client.servers, net.JoinHostPort(server, "53"))
+			}
+		}
+	}
+	if len(client.servers) == 0 {
+		client.servers = []string{"127.0.0.1:53"}
+	}
+	return client
+}
+
+// query asks each name server in turn for the records of the given type
+func (c *dnsClient) query(name string, qtype uint16) ([]dnsAnswer, error) {
+	request, id, err := buildDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range c.servers {
+		response, err := c.exchangeUDP(server, request)
+		if err == nil && len(response) > 2 && response[2]&0x02 != 0 {
+			// the answer was truncated, ask again over tcp
+			response, err = c.exchangeTCP(server, request)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		answers, err := parseDNSResponse(response, id)
+		if err == errDNSNotFound {
+			return nil, err
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		return answers, nil
+	}
+	return nil, errors.Wrapf(lastErr, "lookup %s", name)
+}
+
+func (c *dnsClient) exchangeUDP(server string, request []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 4096)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+func (c *dnsClient) exchangeTCP(server string, request []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	message := make([]byte, 2+len(request))
+	binary.BigEndian.PutUint16(message, uint16(len(request)))
+	copy(message[2:], request)
+	if _, err = conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func buildDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+
+	// header: id, recursion desired, one question
+	query := []byte{idBytes[0], idBytes[1], 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, errors.Errorf("invalid host name '%s'", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = append(query, byte(qtype>>8), byte(qtype), byte(dnsClassIN>>8), byte(dnsClassIN))
+	return query, id, nil
+}
+
+func parseDNSResponse(msg []byte, id uint16) ([]dnsAnswer, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short dns response")
+	}
+	if binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return nil, errors.New("unexpected dns response")
+	}
+	rcode := msg[3] & 0x0f
+	if rcode == dnsRcodeNameError {
+		return nil, errDNSNotFound
+	} else if rcode != 0 {
+		return nil, errors.Errorf("dns server failure (rcode %d)", rcode)
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:]))
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		var err error
+		if _, offset, err = readDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+
+	answers := []dnsAnswer{}
+	for i := 0; i < anCount; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errors.New("short dns answer")
+		}
+		answer := dnsAnswer{
+			Name: name,
+			Type: binary.BigEndian.Uint16(msg[next:]),
+			TTL:  binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		dataLen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		dataStart := next + 10
+		offset = dataStart + dataLen
+		if offset > len(msg) {
+			return nil, errors.New("short dns answer")
+		}
+		data := msg[dataStart:offset]
+
+		switch answer.Type {
+		case dnsTypeA, dnsTypeAAAA:
+			if len(data) != net.IPv4len && len(data) != net.IPv6len {
+				continue
+			}
+			answer.Value = net.IP(data).String()
+		case dnsTypeCNAME, dnsTypePTR:
+			if answer.Value, _, err = readDNSName(msg, dataStart); err != nil {
+				return nil, err
+			}
+		case dnsTypeMX:
+			if len(data) < 3 {
+				continue
+			}
+			answer.Priority = binary.BigEndian.Uint16(data)
+			if answer.Value, _, err = readDNSName(msg, dataStart+2); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if len(data) < 7 {
+				continue
+			}
+			answer.Priority = binary.BigEndian.Uint16(data)
+			answer.Weight = binary.BigEndian.Uint16(data[2:])
+			answer.Port = binary.BigEndian.Uint16(data[4:])
+			if answer.Value, _, err = readDNSName(msg, dataStart+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeTXT:
+			var text []byte
+			for j := 0; j < len(data); {
+				size := int(data[j])
+				if j+1+size > len(data) {
+					break
+				}
+				text = append(text, data[j+1:j+1+size]...)
+				j += 1 + size
+			}
+			answer.Value = string(text)
+		default:
+			continue
+		}
+		answers = append(answers, answer)
+	}
+	return answers, nil
+}
+
+// readDNSName reads a possibly compressed name and returns it along with the
+// offset of the data that follows it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("short dns name")
+		}
+		size := int(msg[offset])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case size&0xc0 == 0xc0:
+			if offset+1 >= len(msg) || jumps > 32 {
+				return "", 0, errors.New("invalid dns name")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		default:
+			if offset+1+size > len(msg) {
+				return "", 0, errors.New("short dns name")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+}
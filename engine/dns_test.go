@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDNSNameCompressed(t *testing.T) {
+	msg := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	msg = append(msg, 3, 'w', 'w', 'w', 0xc0, 12)
+
+	name, next, err := readDNSName(msg, 12)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "example.com", name, "name does not match")
+	assert.Equal(t, 25, next, "offset does not match")
+
+	name, next, err = readDNSName(msg, 25)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "www.example.com", name, "name does not match")
+	assert.Equal(t, len(msg), next, "offset does not match")
+}
+
+func TestReadDNSNameLoop(t *testing.T) {
+	msg := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xc0, 12}
+	_, _, err := readDNSName(msg, 12)
+	assert.Error(t, err, "expected an error")
+}
+
+func TestDNSClientQuery(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"www.example.com/1": {
+			{Name: "www.example.com", Type: dnsTypeCNAME, TTL: 300, Value: "edge.example.net"},
+			{Name: "edge.example.net", Type: dnsTypeA, TTL: 60, Value: "192.0.2.10"},
+		},
+		"example.com/16": {
+			{Name: "example.com", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 -all"},
+		},
+	})
+	defer stop()
+
+	answers, err := client.query("www.example.com", dnsTypeA)
+	assert.NoError(t, err, "unexpected error")
+	assert.Len(t, answers, 2, "unexpected answers")
+	assert.Equal(t, "edge.example.net", answers[0].Value, "cname does not match")
+	assert.Equal(t, "192.0.2.10", answers[1].Value, "address does not match")
+	assert.Equal(t, uint32(60), answers[1].TTL, "ttl does not match")
+
+	answers, err = client.query("example.com", dnsTypeTXT)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "v=spf1 -all", answers[0].Value, "text does not match")
+
+	_, err = client.query("missing.example.com", dnsTypeA)
+	assert.Equal(t, errDNSNotFound, err, "expected a not found error")
+}
+
+// startTestDNSServer answers queries for "name/type" keys with the given
+// records and returns a client that talks to it, along with a stop function.
+// Keys with nil records answer with a server failure.
+func startTestDNSServer(t *testing.T, records map[string][]dnsAnswer) (*dnsClient, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start dns server: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			name, next, err := readDNSName(buf[:n], 12)
+			if err != nil {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[next:])
+			answers, found := records[name+"/"+strconv.Itoa(int(qtype))]
+
+			response := append([]byte{}, buf[:next+4]...)
+			response[2] = 0x81
+			response[3] = 0x80
+			if !found {
+				response[3] |= dnsRcodeNameError
+			} else if answers == nil {
+				response[3] |= 2
+			}
+			binary.BigEndian.PutUint16(response[6:], uint16(len(answers)))
+			for _, answer := range answers {
+				response = append(response, encodeTestAnswer(answer)...)
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+
+	client := &dnsClient{servers: []string{conn.LocalAddr().String()}, timeout: time.Second}
+	return client, func() { conn.Close() }
+}
+
+// useTestDNS points the resolver at the test server, standing in for the
+// system resolver as well
+func useTestDNS(resolver *Resolver, client *dnsClient) {
+	resolver.client = client
+	resolver.system = func(host string) ([]string, error) {
+		addrs := []string{}
+		notFound := true
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			answers, err := client.query(host, qtype)
+			notFound = notFound && err == errDNSNotFound
+			for _, answer := range answers {
+				if answer.Type == qtype {
+					addrs = append(addrs, answer.Value)
+				}
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: notFound}
+		}
+		return addrs, nil
+	}
+}
+
+func encodeTestAnswer(answer dnsAnswer) []byte {
+	data := []byte{}
+	switch answer.Type {
+	case dnsTypeA:
+		data = net.ParseIP(answer.Value).To4()
+	case dnsTypeAAAA:
+		data = net.ParseIP(answer.Value).To16()
+	case dnsTypeCNAME, dnsTypePTR:
+		data = encodeTestName(answer.Value)
+	case dnsTypeMX:
+		data = append([]byte{byte(answer.Priority >> 8), byte(answer.Priority)}, encodeTestName(answer.Value)...)
+	case dnsTypeSRV:
+		data = []byte{byte(answer.Priority >> 8), byte(answer.Priority),
+			byte(answer.Weight >> 8), byte(answer.Weight),
+			byte(answer.Port >> 8), byte(answer.Port)}
+		data = append(data, encodeTestName(answer.Value)...)
+	case dnsTypeTXT:
+		for text := answer.Value; len(text) > 0; {
+			size := len(text)
+			if size > 255 {
+				size = 255
+			}
+			data = append(data, byte(size))
+			data = append(data, text[:size]...)
+			text = text[size:]
+		}
+	}
+
+	record := encodeTestName(answer.Name)
+	record = append(record, byte(answer.Type>>8), byte(answer.Type), 0, 1)
+	record = append(record, byte(answer.TTL>>24), byte(answer.TTL>>16), byte(answer.TTL>>8), byte(answer.TTL))
+	record = append(record, byte(len(data)>>8), byte(len(data)))
+	return append(record, data...)
+}
+
+func encodeTestName(name string) []byte {
+	encoded := []byte{}
+	for _, label := range strings.Split(name, ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
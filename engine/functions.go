@@ -1,16 +1,24 @@
 package engine
 
 import (
-	"net"
 	"strings"
 	"text/template"
+	"time"
 )
 
-// HostInfo contains the type, address, and name of a host
+// HostInfo contains the type, address, and name of a host, along with how
+// the address was found
 type HostInfo struct {
 	Type string
 	Addr string
 	Name string
+	// Canonical is the name the address is listed under, after following
+	// the aliases in CNAMEs, it is Name when there are no aliases
+	Canonical string
+	CNAMEs    []string
+	// TTL is the DNS TTL of the lookup in seconds
+	TTL      int
+	Resolved time.Time
 }
 
 func NetFuncs() template.FuncMap {
@@ -22,12 +30,41 @@ func NetFuncs() template.FuncMap {
 		"lookupHosts":     LookupHosts,
 		"lookupIPv4Host":  LookupIPv4Host,
 		"lookupIPv6Host":  LookupIPv6Host,
+		"lookupSRV":       LookupSRV,
+		"lookupMX":        LookupMX,
+		"lookupTXT":       LookupTXT,
+		"lookupCNAME":     LookupCNAME,
+		"lookupAddr":      LookupAddr,
+		"spfAddrs":        SPFAddrs,
 		"isValidIPv4":     IsValidIPv4,
 		"isValidIPv6":     IsValidIPv6,
 		"isValidIPv4Addr": IsValidIPv4Addr,
 		"isValidIPv6Addr": IsValidIPv6Addr,
 		"isValidIPv4CIDR": IsValidIPv4CIDR,
 		"isValidIPv6CIDR": IsValidIPv6CIDR,
+		"ipFamily":        IPFamily,
+		"isIPv4Mapped":    IsIPv4Mapped,
+		"ipCanonical":     IPCanonical,
+		"isPrivate":       IsPrivate,
+		"isLoopback":      IsLoopback,
+		"isLinkLocal":     IsLinkLocal,
+		"isMulticast":     IsMulticast,
+		"cidrContains":    CIDRContains,
+		"cidrNetwork":     CIDRNetwork,
+		"cidrBroadcast":   CIDRBroadcast,
+		"cidrHost":        CIDRHost,
+		"cidrSubnets":     CIDRSubnets,
+		"cidrOverlaps":    CIDROverlaps,
+		"cidrMerge":       CIDRMerge,
+		"parseIPRange":    ParseIPRange,
+		"isValidIPRange":  IsValidIPRange,
+		"ipRangeCIDRs":    IPRangeCIDRs,
+		"iprangeSrc":      IPRangeSrc,
+		"iprangeDst":      IPRangeDst,
+		"port":            Port,
+		"isValidPort":     IsValidPort,
+		"mergePorts":      MergePorts,
+		"multiportChunks": MultiportChunks,
 	}
 
 	return funcMap
@@ -76,62 +113,47 @@ func RPad(size int, str interface{}) string {
 
 // LookupHosts returns a list of HostInfo objects
 func LookupHosts(hosts []interface{}) []HostInfo {
-	host4Info := []HostInfo{}
-	host6Info := []HostInfo{}
-	for _, host := range hosts {
-		addrs, _ := lookupHost(host)
-		for _, addr := range addrs {
-			if IsValidIPv4(addr) {
-				host4Info = append(host4Info, HostInfo{"4", addr, host.(string)})
-			} else if IsValidIPv6(addr) {
-				host6Info = append(host6Info, HostInfo{"6", addr, host.(string)})
-			}
-		}
-	}
-	return append(host4Info, host6Info...)
-}
-
-func lookupHost(host interface{}) ([]string, error) {
-	addrs, err := net.LookupHost(host.(string))
-	if err != nil {
-		return []string{}, err
-	}
-
-	return addrs, nil
+	return defaultResolver.LookupHosts(hosts)
 }
 
 // LookupIPv4Host returns a list of the given host's IPv4 addresses
 func LookupIPv4Host(host string) ([]string, error) {
-	addrs, err := net.LookupHost(host)
-	if err != nil {
-		return []string{}, err
-	}
-
-	ipv4Addrs := []string{}
-	for _, addr := range addrs {
-		ip := net.ParseIP(addr)
-		if ip.To4() != nil {
-			ipv4Addrs = append(ipv4Addrs, addr)
-		}
-	}
-	return ipv4Addrs, err
+	return defaultResolver.LookupIPv4Host(host)
 }
 
 // LookupIPv6Host returns a list of the given host's IPv6 addresses
 func LookupIPv6Host(host string) ([]string, error) {
-	addrs, err := net.LookupHost(host)
-	if err != nil {
-		return []string{}, err
-	}
+	return defaultResolver.LookupIPv6Host(host)
+}
 
-	ipv6Addrs := []string{}
-	for _, addr := range addrs {
-		ip := net.ParseIP(addr)
-		if ip.To4() == nil {
-			ipv6Addrs = append(ipv6Addrs, addr)
-		}
-	}
-	return ipv6Addrs, err
+// LookupSRV returns the SRV records of the given name
+func LookupSRV(name string) ([]SRVRecord, error) {
+	return defaultResolver.LookupSRV(name)
+}
+
+// LookupMX returns the mail servers of the given domain
+func LookupMX(domain string) ([]MXRecord, error) {
+	return defaultResolver.LookupMX(domain)
+}
+
+// LookupTXT returns the TXT records of the given name
+func LookupTXT(name string) ([]string, error) {
+	return defaultResolver.LookupTXT(name)
+}
+
+// LookupCNAME returns the canonical name of the given name
+func LookupCNAME(name string) (string, error) {
+	return defaultResolver.LookupCNAME(name)
+}
+
+// LookupAddr returns the names the given address points back to
+func LookupAddr(addr string) ([]string, error) {
+	return defaultResolver.LookupAddr(addr)
+}
+
+// SPFAddrs returns the addresses allowed by the SPF record of the given domain
+func SPFAddrs(domain string) ([]HostInfo, error) {
+	return defaultResolver.SPFAddrs(domain)
 }
 
 // IsValidIPv4 returns true if the given address is a valid IPv4 address or IPv4 CIDR range
@@ -146,24 +168,25 @@ func IsValidIPv6(addr string) bool {
 
 // IsValidIPv4Addr returns true if the given address is a valid IPv4 address
 func IsValidIPv4Addr(addr string) bool {
-	ip := net.ParseIP(addr)
-	return ip.To4() != nil
+	family, err := IPFamily(addr)
+	return err == nil && family == 4 && !strings.Contains(addr, "/")
 }
 
-// IsValidIPv6Addr returns true if the given address is a valid IPv6 address
+// IsValidIPv6Addr returns true if the given address is a valid IPv6 address,
+// IPv4 addresses are not
 func IsValidIPv6Addr(addr string) bool {
-	ip := net.ParseIP(addr)
-	return ip.To16() != nil
+	family, err := IPFamily(addr)
+	return err == nil && family == 6 && !strings.Contains(addr, "/")
 }
 
 // IsValidIPv4CIDR returns true if the given address is a valid IPv4 CIDR range
 func IsValidIPv4CIDR(addr string) bool {
-	ip, _, err := net.ParseCIDR(addr)
-	return err == nil && IsValidIPv4Addr(ip.String())
+	family, err := IPFamily(addr)
+	return err == nil && family == 4 && strings.Contains(addr, "/")
 }
 
 // IsValidIPv6CIDR returns true if the given address is a valid IPv6 CIDR range
 func IsValidIPv6CIDR(addr string) bool {
-	ip, _, err := net.ParseCIDR(addr)
-	return err == nil && IsValidIPv6Addr(ip.String())
+	family, err := IPFamily(addr)
+	return err == nil && family == 6 && strings.Contains(addr, "/")
 }
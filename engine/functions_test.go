@@ -49,6 +49,9 @@ func TestIsValidIPv6Addr(t *testing.T) {
 	assert.True(t, result, "unexpected result")
 
 	result = IsValidIPv6Addr("127.0.0.1")
+	assert.False(t, result, "unexpected result")
+
+	result = IsValidIPv6Addr("::ffff:127.0.0.1")
 	assert.True(t, result, "unexpected result")
 
 	result = IsValidIPv6Addr("rando")
@@ -77,7 +80,7 @@ func TestIsValidIPv6CIDR(t *testing.T) {
 	assert.True(t, result, "unexpected result")
 
 	result = IsValidIPv6CIDR("10.0.0.0/8")
-	assert.True(t, result, "unexpected result")
+	assert.False(t, result, "unexpected result")
 
 	result = IsValidIPv6CIDR("::1")
 	assert.False(t, result, "unexpected result")
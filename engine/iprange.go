@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IPRange is an inclusive range of addresses, like 10.1.0.5-10.1.0.90
+type IPRange struct {
+	Start  string
+	End    string
+	Family int
+}
+
+func (r IPRange) String() string {
+	return r.Start + "-" + r.End
+}
+
+// span returns the addresses of the range as numbers
+func (r IPRange) span() ipRange {
+	start, _ := parseNet(r.Start)
+	end, _ := parseNet(r.End)
+	return ipRange{ipToInt(start.IP), ipToInt(end.IP), len(start.IP) * 8}
+}
+
+// ParseIPRange parses a range of addresses written as start-end. Both ends
+// must be addresses of the same family and the start can not come after the
+// end.
+func ParseIPRange(value string) (IPRange, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return IPRange{}, errors.Errorf("invalid ip range '%s'", value)
+	}
+
+	ends := []string{}
+	families := []int{}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		family, err := IPFamily(part)
+		if err != nil || strings.Contains(part, "/") {
+			return IPRange{}, errors.Errorf("invalid address '%s' in ip range '%s'", part, value)
+		}
+		canonical, _ := IPCanonical(part)
+		ends = append(ends, canonical)
+		families = append(families, family)
+	}
+	if families[0] != families[1] {
+		return IPRange{}, errors.Errorf("the ends of ip range '%s' are not the same family", value)
+	}
+
+	r := IPRange{Start: ends[0], End: ends[1], Family: families[0]}
+	if span := r.span(); span.start.Cmp(span.end) > 0 {
+		return IPRange{}, errors.Errorf("ip range '%s' starts after it ends", value)
+	}
+	return r, nil
+}
+
+// IsValidIPRange returns true if the given value is a valid ip range
+func IsValidIPRange(value string) bool {
+	_, err := ParseIPRange(value)
+	return err == nil
+}
+
+// IPRangeCIDRs returns the fewest CIDR ranges that cover the ip range
+func IPRangeCIDRs(value string) ([]string, error) {
+	r, err := ParseIPRange(value)
+	if err != nil {
+		return nil, err
+	}
+	return r.span().cidrs(), nil
+}
+
+// IPRangeSrc returns the iptables arguments that match the ip range as the
+// source address
+func IPRangeSrc(value string) (string, error) {
+	return iprangeArgs("--src-range", value)
+}
+
+// IPRangeDst returns the iptables arguments that match the ip range as the
+// destination address
+func IPRangeDst(value string) (string, error) {
+	return iprangeArgs("--dst-range", value)
+}
+
+func iprangeArgs(option string, value string) (string, error) {
+	r, err := ParseIPRange(value)
+	if err != nil {
+		return "", err
+	}
+	return "-m iprange " + option + " " + r.String(), nil
+}
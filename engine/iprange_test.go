@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPRange(t *testing.T) {
+	r, err := ParseIPRange("10.1.0.5-10.1.0.90")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, IPRange{"10.1.0.5", "10.1.0.90", 4}, r, "range does not match")
+	assert.Equal(t, "10.1.0.5-10.1.0.90", r.String(), "range does not match")
+
+	r, err = ParseIPRange(" 2001:DB8::1 - 2001:db8::ff ")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, IPRange{"2001:db8::1", "2001:db8::ff", 6}, r, "range does not match")
+
+	invalid := []string{
+		"10.1.0.5",
+		"10.1.0.5-",
+		"10.1.0.5-10.1.0.6-10.1.0.7",
+		"10.1.0.5-2001:db8::1",
+		"10.1.0.90-10.1.0.5",
+		"10.1.0.0/24-10.1.1.0",
+		"rando-10.1.0.5",
+	}
+	for _, value := range invalid {
+		_, err = ParseIPRange(value)
+		assert.Error(t, err, "expected an error for %s", value)
+		assert.False(t, IsValidIPRange(value), "unexpected result for %s", value)
+	}
+}
+
+func TestIPRangeCIDRs(t *testing.T) {
+	cidrs, err := IPRangeCIDRs("10.1.0.5-10.1.0.90")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.1.0.5/32", "10.1.0.6/31", "10.1.0.8/29", "10.1.0.16/28",
+		"10.1.0.32/27", "10.1.0.64/28", "10.1.0.80/29", "10.1.0.88/31", "10.1.0.90/32"},
+		cidrs, "cidrs do not match")
+
+	cidrs, err = IPRangeCIDRs("2001:db8::-2001:db8::ffff")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"2001:db8::/112"}, cidrs, "cidrs do not match")
+
+	cidrs, err = CIDRMerge("10.1.0.0-10.1.0.127", "10.1.0.128/25")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.1.0.0/24"}, cidrs, "cidrs do not match")
+}
+
+func TestIPRangeArgs(t *testing.T) {
+	args, err := IPRangeSrc("10.1.0.5-10.1.0.90")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "-m iprange --src-range 10.1.0.5-10.1.0.90", args, "args do not match")
+
+	args, err = IPRangeDst("2001:db8::1-2001:db8::ff")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "-m iprange --dst-range 2001:db8::1-2001:db8::ff", args, "args do not match")
+
+	_, err = IPRangeSrc("10.1.0.5-2001:db8::1")
+	assert.Error(t, err, "expected an error")
+}
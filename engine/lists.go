@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var hostnamePattern = regexp.MustCompile(`^(?i)([a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9])?\.)*[a-z0-9_]([a-z0-9_-]{0,61}[a-z0-9])?\.?$`)
+
+// ReadList reads a list of addresses, CIDR ranges, ip ranges and hostnames,
+// one per line with # comments, from a file relative to the template. Each
+// entry is returned once, in the order of the file. Hostnames are returned
+// with the "host" type, or replaced by their addresses when resolve is set.
+func (r *RuleSet) ReadList(listPath string, resolve ...bool) ([]HostInfo, error) {
+	filePath := r.dataPath(listPath)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read list")
+	}
+	defer file.Close()
+
+	items := []HostInfo{}
+	seen := make(map[string]bool)
+	add := func(info HostInfo) {
+		if !seen[info.Addr] {
+			seen[info.Addr] = true
+			items = append(items, info)
+		}
+	}
+
+	lineNum := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNum++
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		info, err := parseListEntry(entry)
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: %v", listPath, lineNum, err)
+		}
+		if info.Type != "host" || len(resolve) == 0 || !resolve[0] {
+			add(info)
+			continue
+		}
+
+		if _, err = r.resolver.LookupHost(entry); err != nil {
+			return nil, errors.Errorf("%s:%d: %v", listPath, lineNum, err)
+		}
+		for _, host := range r.resolver.LookupHosts([]interface{}{entry}) {
+			add(host)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read list")
+	}
+	return items, nil
+}
+
+// parseListEntry checks a list entry and returns it in its standard form
+func parseListEntry(entry string) (HostInfo, error) {
+	host := strings.ToLower(strings.TrimSuffix(entry, "."))
+	// top level domains are never numbers, so these are meant as addresses
+	labels := strings.Split(host, ".")
+	address := strings.ContainsAny(entry, ":/") || isNumber(labels[len(labels)-1])
+
+	if strings.Contains(entry, "-") && address {
+		r, err := ParseIPRange(entry)
+		if err != nil {
+			return HostInfo{}, err
+		}
+		return HostInfo{Type: strconv.Itoa(r.Family), Addr: r.String(), Name: entry}, nil
+	}
+	if family, err := IPFamily(entry); err == nil {
+		canonical, _ := IPCanonical(entry)
+		return HostInfo{Type: strconv.Itoa(family), Addr: canonical, Name: entry}, nil
+	}
+	if address || !hostnamePattern.MatchString(entry) {
+		return HostInfo{}, errors.Errorf("invalid entry '%s'", entry)
+	}
+	return HostInfo{Type: "host", Addr: host, Name: host}, nil
+}
+
+// dataPath finds a file read by the template, relative to the template
+// first like imports, and remembers it so changes to it are noticed
+func (r *RuleSet) dataPath(filePath string) string {
+	if !filepath.IsAbs(filePath) {
+		relativePath := path.Join(path.Dir(r.templatePath), filePath)
+		if fileExists(relativePath) || !fileExists(filePath) {
+			filePath = relativePath
+		}
+	}
+	for _, known := range r.dataFiles {
+		if known == filePath {
+			return filePath
+		}
+	}
+	r.dataFiles = append(r.dataFiles, filePath)
+	return filePath
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.Atoi(value)
+	return err == nil
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadList(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	rulesFilePath := path.Join(dirPath, "rules.tr")
+	err = ioutil.WriteFile(rulesFilePath, []byte(
+		`{{ range readList "lists/partners.txt" }}{{ .Type }} {{ .Addr }}
+{{ end }}`), 0644)
+	assert.NoError(t, err, "test file write error")
+	err = os.Mkdir(path.Join(dirPath, "lists"), 0755)
+	assert.NoError(t, err, "failed to make dir")
+	listFilePath := path.Join(dirPath, "lists", "partners.txt")
+	err = ioutil.WriteFile(listFilePath, []byte(`# partners
+192.0.2.10
+198.51.100.7/24   # office
+
+2001:DB8::1
+10.1.0.5-10.1.0.90
+mail.Example.com.
+192.0.2.10
+`), 0644)
+	assert.NoError(t, err, "test file write error")
+
+	ruleset, err := NewRuleset(rulesFilePath)
+	assert.NoError(t, err, "unexpected error")
+	rules, err := ruleset.GenerateRules("test")
+	assert.NoError(t, err, "unexpected error")
+	assert.Contains(t, string(rules), `4 192.0.2.10
+4 198.51.100.0/24
+6 2001:db8::1
+4 10.1.0.5-10.1.0.90
+host mail.example.com
+`, "rules do not match")
+	assert.Equal(t, []string{rulesFilePath, listFilePath}, ruleset.Files(), "files do not match")
+}
+
+func TestReadListResolve(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"mail.example.com/1": {
+			{Name: "mail.example.com", Type: dnsTypeA, TTL: 300, Value: "192.0.2.25"},
+		},
+		"mail.example.com/28": {},
+	})
+	defer stop()
+
+	listFilePath, err := writeTempFile([]byte("192.0.2.25\nmail.example.com\n"))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(listFilePath) // clean up
+
+	ruleset := &RuleSet{templatePath: "rules.tr", resolver: NewResolver()}
+	useTestDNS(ruleset.resolver, client)
+	items, err := ruleset.ReadList(listFilePath, true)
+	assert.NoError(t, err, "unexpected error")
+	assert.Len(t, items, 1, "duplicate addresses should be left out")
+	assert.Equal(t, "192.0.2.25", items[0].Addr, "address does not match")
+}
+
+func TestReadListErrors(t *testing.T) {
+	listFilePath, err := writeTempFile([]byte("192.0.2.1\n# comment\n192.0.2.300\n"))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(listFilePath) // clean up
+
+	ruleset := &RuleSet{templatePath: "rules.tr", resolver: NewResolver()}
+	_, err = ruleset.ReadList(listFilePath)
+	assert.EqualError(t, err, listFilePath+":3: invalid entry '192.0.2.300'", "error does not match")
+
+	_, err = ruleset.ReadList("missing.txt")
+	assert.Error(t, err, "expected an error")
+	assert.Contains(t, ruleset.Files(), "missing.txt", "missing lists should be watched")
+}
+
+func TestParseListEntry(t *testing.T) {
+	valid := map[string]string{
+		"192.0.2.1":          "4 192.0.2.1",
+		"192.0.2.1/24":       "4 192.0.2.0/24",
+		"2001:db8::/32":      "6 2001:db8::/32",
+		"fe80::1-fe80::ff":   "6 fe80::1-fe80::ff",
+		"host-1.example.com": "host host-1.example.com",
+		"localhost":          "host localhost",
+	}
+	for entry, expected := range valid {
+		info, err := parseListEntry(entry)
+		assert.NoError(t, err, "unexpected error for %s", entry)
+		assert.Equal(t, expected, info.Type+" "+info.Addr, "entry does not match")
+	}
+
+	for _, entry := range []string{"192.0.2.1/33", "10.0.0.9-10.0.0.1", "bad host", "-bad.example.com", "::g"} {
+		_, err := parseListEntry(entry)
+		assert.Error(t, err, "expected an error for %s", entry)
+	}
+}
@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxMultiportSlots is how many ports a single multiport match takes, a range
+// takes two
+const maxMultiportSlots = 15
+
+// servicesPath is where service names are looked up
+var servicesPath = "/etc/services"
+
+var services = struct {
+	sync.Mutex
+	path  string
+	ports map[string]int
+}{}
+
+// portRange is an inclusive range of ports, a single port starts and ends on
+// the same number
+type portRange struct {
+	start int
+	end   int
+}
+
+func (r portRange) String() string {
+	if r.start == r.end {
+		return strconv.Itoa(r.start)
+	}
+	return fmt.Sprintf("%d:%d", r.start, r.end)
+}
+
+// slots returns how many of the multiport ports the range takes
+func (r portRange) slots() int {
+	if r.start == r.end {
+		return 1
+	}
+	return 2
+}
+
+// Port returns the port number of a service name from /etc/services, like
+// "https" or "domain/udp". Without a protocol the tcp port is preferred.
+// Port numbers are returned as they are.
+func Port(service string) (int, error) {
+	service = strings.TrimSpace(service)
+	if num, err := strconv.Atoi(service); err == nil {
+		if num < 1 || num > 65535 {
+			return 0, errors.Errorf("invalid port %d", num)
+		}
+		return num, nil
+	}
+
+	ports, err := loadServices()
+	if err != nil {
+		return 0, err
+	}
+	name := strings.ToLower(service)
+	if !strings.Contains(name, "/") {
+		if num, ok := ports[name+"/tcp"]; ok {
+			return num, nil
+		}
+	}
+	if num, ok := ports[name]; ok {
+		return num, nil
+	}
+	return 0, errors.Errorf("unknown service '%s'", service)
+}
+
+// IsValidPort returns true if the given value is a port, a service name or a
+// range of them written as start:end or start-end
+func IsValidPort(value interface{}) bool {
+	ports, err := flattenPorts([]interface{}{value})
+	if err != nil || len(ports) != 1 {
+		return false
+	}
+	_, err = parsePortRange(ports[0])
+	return err == nil
+}
+
+// MergePorts returns the given ports, service names and ranges as port
+// numbers, sorted, with overlapping and adjacent ports joined into ranges.
+// Arguments can be ports or lists of ports.
+func MergePorts(items ...interface{}) ([]string, error) {
+	ranges, err := mergedPortRanges(items)
+	if err != nil {
+		return nil, err
+	}
+	merged := []string{}
+	for _, r := range ranges {
+		merged = append(merged, r.String())
+	}
+	return merged, nil
+}
+
+// MultiportChunks merges the given ports like MergePorts and splits them into
+// comma separated groups that each fit in a single multiport match
+func MultiportChunks(items ...interface{}) ([]string, error) {
+	ranges, err := mergedPortRanges(items)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := []string{}
+	chunk := []string{}
+	slots := 0
+	for _, r := range ranges {
+		if slots+r.slots() > maxMultiportSlots {
+			chunks = append(chunks, strings.Join(chunk, ","))
+			chunk = []string{}
+			slots = 0
+		}
+		chunk = append(chunk, r.String())
+		slots += r.slots()
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, strings.Join(chunk, ","))
+	}
+	return chunks, nil
+}
+
+func mergedPortRanges(items []interface{}) ([]portRange, error) {
+	ports, err := flattenPorts(items)
+	if err != nil {
+		return nil, err
+	}
+	ranges := []portRange{}
+	for _, port := range ports {
+		r, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	merged := []portRange{}
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			if r.start <= last.end+1 {
+				if r.end > last.end {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// parsePortRange parses a port, service name or a range of them. Service
+// names can have dashes, so a range with a dash is only tried when the whole
+// value is not a service.
+func parsePortRange(value string) (portRange, error) {
+	port, err := Port(value)
+	if err == nil {
+		return portRange{port, port}, nil
+	}
+	sep := ":"
+	if !strings.Contains(value, sep) {
+		sep = "-"
+	}
+	parts := strings.Split(value, sep)
+	if len(parts) != 2 {
+		return portRange{}, err
+	}
+
+	start, err := Port(parts[0])
+	if err != nil {
+		return portRange{}, err
+	}
+	end, err := Port(parts[1])
+	if err != nil {
+		return portRange{}, err
+	}
+	if start > end {
+		return portRange{}, errors.Errorf("port range '%s' starts after it ends", value)
+	}
+	return portRange{start, end}, nil
+}
+
+// flattenPorts turns template arguments that are ports or lists of ports into
+// a single list, yaml variables give numbers for plain ports
+func flattenPorts(items []interface{}) ([]string, error) {
+	flat := []string{}
+	for _, item := range items {
+		switch value := item.(type) {
+		case int:
+			flat = append(flat, strconv.Itoa(value))
+		case int64:
+			flat = append(flat, strconv.FormatInt(value, 10))
+		case float64:
+			flat = append(flat, strconv.FormatFloat(value, 'f', -1, 64))
+		case string:
+			// multiport style lists
+			for _, port := range strings.Split(value, ",") {
+				flat = append(flat, strings.TrimSpace(port))
+			}
+		case []string:
+			values, err := flattenPorts(stringsToItems(value))
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, values...)
+		case []interface{}:
+			values, err := flattenPorts(value)
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, values...)
+		default:
+			return nil, errors.Errorf("expected a port or a list, got %T", item)
+		}
+	}
+	return flat, nil
+}
+
+func stringsToItems(values []string) []interface{} {
+	items := []interface{}{}
+	for _, value := range values {
+		items = append(items, value)
+	}
+	return items
+}
+
+// loadServices reads the service ports once, keyed by name/protocol and by
+// name alone for the first protocol listed
+func loadServices() (map[string]int, error) {
+	services.Lock()
+	defer services.Unlock()
+	if services.ports != nil && services.path == servicesPath {
+		return services.ports, nil
+	}
+
+	file, err := os.Open(servicesPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read services")
+	}
+	defer file.Close()
+
+	ports := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		portProto := strings.SplitN(fields[1], "/", 2)
+		if len(portProto) != 2 {
+			continue
+		}
+		num, err := strconv.Atoi(portProto[0])
+		if err != nil {
+			continue
+		}
+		names := append([]string{fields[0]}, fields[2:]...)
+		for _, name := range names {
+			name = strings.ToLower(name)
+			ports[name+"/"+strings.ToLower(portProto[1])] = num
+			if _, ok := ports[name]; !ok {
+				ports[name] = num
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read services")
+	}
+
+	services.path = servicesPath
+	services.ports = ports
+	return ports, nil
+}
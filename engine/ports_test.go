@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useServices(t *testing.T) func() {
+	file, err := ioutil.TempFile("", "services")
+	assert.NoError(t, err, "unexpected error")
+	file.WriteString(`# Network services
+ssh		22/tcp				# SSH Remote Login Protocol
+domain		53/tcp				# Domain Name Server
+domain		53/udp
+http		80/tcp		www		# WorldWideWeb HTTP
+https		443/tcp
+syslog		514/udp
+http-alt	8080/tcp	webcache
+`)
+	file.Close()
+
+	previous := servicesPath
+	servicesPath = file.Name()
+	return func() {
+		servicesPath = previous
+		os.Remove(file.Name())
+	}
+}
+
+func TestPort(t *testing.T) {
+	defer useServices(t)()
+
+	tests := []struct {
+		service string
+		port    int
+	}{
+		{"22", 22},
+		{"https", 443},
+		{"HTTPS", 443},
+		{"www", 80},
+		{"domain/udp", 53},
+		{"syslog", 514},
+		{"http-alt", 8080},
+	}
+	for _, test := range tests {
+		port, err := Port(test.service)
+		assert.NoError(t, err, "unexpected error")
+		assert.Equal(t, test.port, port, "port does not match for %s", test.service)
+	}
+
+	_, err := Port("gopher")
+	assert.Error(t, err, "expected an error")
+	_, err = Port("syslog/tcp")
+	assert.Error(t, err, "expected an error")
+	_, err = Port("70000")
+	assert.Error(t, err, "expected an error")
+}
+
+func TestIsValidPort(t *testing.T) {
+	defer useServices(t)()
+
+	assert.True(t, IsValidPort(22), "unexpected result")
+	assert.True(t, IsValidPort("ssh"), "unexpected result")
+	assert.True(t, IsValidPort("8000:8100"), "unexpected result")
+	assert.True(t, IsValidPort("8000-8100"), "unexpected result")
+	assert.True(t, IsValidPort("http:https"), "unexpected result")
+	assert.False(t, IsValidPort("8100:8000"), "unexpected result")
+	assert.False(t, IsValidPort("0"), "unexpected result")
+	assert.False(t, IsValidPort("22,80"), "unexpected result")
+	assert.False(t, IsValidPort("gopher"), "unexpected result")
+}
+
+func TestMergePorts(t *testing.T) {
+	defer useServices(t)()
+
+	ports, err := MergePorts([]interface{}{443, "http", 81}, "22,8000:8100", []string{"8050-8200", "ssh", "82"})
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"22", "80:82", "443", "8000:8200"}, ports, "ports do not match")
+
+	_, err = MergePorts("22", true)
+	assert.Error(t, err, "expected an error")
+}
+
+func TestMultiportChunks(t *testing.T) {
+	ports := []interface{}{}
+	for port := 1000; port < 1030; port += 2 {
+		ports = append(ports, port)
+	}
+	chunks, err := MultiportChunks(ports, "2000:2100", 3000)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{
+		"1000,1002,1004,1006,1008,1010,1012,1014,1016,1018,1020,1022,1024,1026,1028",
+		"2000:2100,3000",
+	}, chunks, "chunks do not match")
+
+	chunks, err = MultiportChunks()
+	assert.NoError(t, err, "unexpected error")
+	assert.Empty(t, chunks, "unexpected chunks")
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultProvenance is the comment added to rules when provenance is on
+const DefaultProvenance = "templr:{file}:{line}"
+
+// ruleLineRegex matches the start of an append or insert rule, up to the
+// chain and the optional rule number. The family flag can be a run of
+// template actions, like {{ if .v4 }}-4{{ else }}-6{{ end }}, and the chain
+// can be a template action.
+var ruleLineRegex = regexp.MustCompile(`^(\s*(?:(?:-[46]|-?{{[^}]*}})\s*)*-[AI]\s+(?:{{[^}]*}}|\S+)(?:\s+\d+\b)?)`)
+
+// annotateRules adds the provenance comment right after the chain of every
+// rule in the file. This runs before the imports are expanded, so the line
+// numbers match the file the rule was written in.
+func (r *RuleSet) annotateRules(fileBytes []byte, filePath string) []byte {
+	if len(r.options.Provenance) == 0 {
+		return fileBytes
+	}
+
+	name := r.relativePath(filePath)
+	lines := bytes.Split(fileBytes, []byte("\n"))
+	for i, line := range lines {
+		match := ruleLineRegex.FindSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		comment := ProvenanceComment(r.options.Provenance, name, i+1)
+		annotated := append([]byte{}, line[:match[3]]...)
+		annotated = append(annotated, " -m comment --comment "...)
+		annotated = append(annotated, strconv.Quote(comment)...)
+		lines[i] = append(annotated, line[match[3]:]...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// relativePath returns the path of a file from the template directory, files
+// outside of it keep their full path
+func (r *RuleSet) relativePath(filePath string) string {
+	rel, err := filepath.Rel(filepath.Dir(r.templatePath), filePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return filePath
+	}
+	return rel
+}
+
+// ProvenanceComment fills in the provenance format for a rule
+func ProvenanceComment(format string, file string, line int) string {
+	return strings.NewReplacer("{file}", file, "{line}", strconv.Itoa(line)).Replace(format)
+}
@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenanceComments(t *testing.T) {
+	importDirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(importDirPath) // clean up
+
+	rulesFilePath := path.Join(importDirPath, "rules.yml")
+	err = ioutil.WriteFile(rulesFilePath, []byte(`*filter
+# -A INPUT in a comment is left alone
+-A INPUT -i lo -j ACCEPT
+{@ ssh.tr @}
+-{{ "4" }} -I OUTPUT 2 -o lo -j ACCEPT
+{{ if eq "4" "4" }}-4{{ else }}-6{{ end }} -A INPUT -p icmp -j ACCEPT
+COMMIT
+`), 0644)
+	assert.NoError(t, err, "test file write error")
+	err = ioutil.WriteFile(path.Join(importDirPath, "ssh.tr"), []byte(`
+  -6 -A INPUT -p tcp --dport 22 -j ACCEPT`), 0644)
+	assert.NoError(t, err, "test file write error")
+
+	ruleset, err := NewRulesetWithOptions(rulesFilePath, Options{Provenance: DefaultProvenance})
+	assert.NoError(t, err, "unexpected error")
+	rules, err := ruleset.GenerateRules("test")
+	assert.NoError(t, err, "unexpected error")
+
+	assert.Contains(t, string(rules), "# -A INPUT in a comment is left alone\n")
+	assert.Contains(t, string(rules), `-A INPUT -m comment --comment "templr:rules.yml:3" -i lo -j ACCEPT`)
+	assert.Contains(t, string(rules), `  -6 -A INPUT -m comment --comment "templr:ssh.tr:2" -p tcp --dport 22 -j ACCEPT`)
+	assert.Contains(t, string(rules), `-4 -I OUTPUT 2 -m comment --comment "templr:rules.yml:5" -o lo -j ACCEPT`)
+	assert.Contains(t, string(rules), `-4 -A INPUT -m comment --comment "templr:rules.yml:6" -p icmp -j ACCEPT`)
+}
+
+func TestProvenanceComment(t *testing.T) {
+	assert.Equal(t, "fw:conf.d/ssh.tr:12", ProvenanceComment("fw:{file}:{line}", "conf.d/ssh.tr", 12))
+	assert.Equal(t, "managed-by-templr", ProvenanceComment("managed-by-templr", "rules.yml", 1))
+}
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxCNAMEHops limits how many aliases LookupCNAME follows
+const maxCNAMEHops = 8
+
+var recordTypeNames = map[uint16]string{
+	dnsTypeCNAME: "CNAME",
+	dnsTypePTR:   "PTR",
+	dnsTypeMX:    "MX",
+	dnsTypeTXT:   "TXT",
+	dnsTypeSRV:   "SRV",
+}
+
+// SRVRecord is a service location found by lookupSRV
+type SRVRecord struct {
+	Target   string
+	Port     int
+	Priority int
+	Weight   int
+}
+
+// MXRecord is a mail server found by lookupMX
+type MXRecord struct {
+	Host     string
+	Priority int
+}
+
+// LookupSRV returns the SRV records of the name, like _sip._tcp.example.com,
+// sorted by priority and then by weight, heaviest first
+func (r *Resolver) LookupSRV(name string) ([]SRVRecord, error) {
+	answers, err := r.lookupRecords(name, dnsTypeSRV)
+	records := []SRVRecord{}
+	for _, answer := range answers {
+		records = append(records, SRVRecord{
+			Target:   answer.Value,
+			Port:     int(answer.Port),
+			Priority: int(answer.Priority),
+			Weight:   int(answer.Weight),
+		})
+	}
+	return records, err
+}
+
+// LookupMX returns the mail servers of the domain, sorted by priority
+func (r *Resolver) LookupMX(domain string) ([]MXRecord, error) {
+	answers, err := r.lookupRecords(domain, dnsTypeMX)
+	records := []MXRecord{}
+	for _, answer := range answers {
+		records = append(records, MXRecord{Host: answer.Value, Priority: int(answer.Priority)})
+	}
+	return records, err
+}
+
+// LookupTXT returns the sorted TXT records of the name
+func (r *Resolver) LookupTXT(name string) ([]string, error) {
+	answers, err := r.lookupRecords(name, dnsTypeTXT)
+	records := []string{}
+	for _, answer := range answers {
+		records = append(records, answer.Value)
+	}
+	return records, err
+}
+
+// LookupCNAME follows the aliases of the name and returns the canonical name,
+// which is the name itself when it has no alias
+func (r *Resolver) LookupCNAME(name string) (string, error) {
+	canonical := strings.TrimSuffix(name, ".")
+	for hops := 0; hops < maxCNAMEHops; hops++ {
+		answers, err := r.lookupRecords(canonical, dnsTypeCNAME)
+		if err != nil {
+			return "", err
+		}
+		if len(answers) == 0 {
+			return canonical, nil
+		}
+		canonical = answers[0].Value
+	}
+	return "", errors.Errorf("lookup %s: too many aliases", name)
+}
+
+// LookupAddr returns the sorted names that the PTR records of the address
+// point to
+func (r *Resolver) LookupAddr(addr string) ([]string, error) {
+	name, err := reverseName(addr)
+	if err != nil {
+		return []string{}, err
+	}
+	answers, err := r.lookupRecords(name, dnsTypePTR)
+	names := []string{}
+	for _, answer := range answers {
+		names = append(names, answer.Value)
+	}
+	return names, err
+}
+
+// lookupRecords returns the sorted records of the given type, using the
+// cached result until it expires
+func (r *Resolver) lookupRecords(name string, qtype uint16) ([]dnsAnswer, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := recordKey(name, qtype)
+	entry, ok := r.hosts[key]
+	if !ok || entry.expired(time.Now()) {
+		entry = keepOnFailure(entry, r.resolveRecords(name, qtype))
+		r.hosts[key] = entry
+	}
+	return entry.records, entry.err
+}
+
+func (r *Resolver) resolveRecords(name string, qtype uint16) *hostEntry {
+	entry := &hostEntry{
+		name:     name,
+		qtype:    qtype,
+		records:  []dnsAnswer{},
+		addrs:    []string{},
+		ttl:      DefaultTTL,
+		resolved: time.Now(),
+	}
+
+	atomic.AddUint64(&dnsLookups, 1)
+	answers, err := r.client.query(name, qtype)
+	if err == errDNSNotFound {
+		entry.err = errors.Errorf("lookup %s: %v", name, err)
+	} else if err != nil {
+		entry.err = err
+		entry.transient = true
+	}
+	if entry.err != nil {
+		atomic.AddUint64(&dnsFailures, 1)
+		return entry
+	}
+
+	first := true
+	for _, answer := range answers {
+		if answer.Type != qtype {
+			continue
+		}
+		if first || time.Duration(answer.TTL)*time.Second < entry.ttl {
+			entry.ttl = time.Duration(answer.TTL) * time.Second
+			first = false
+		}
+		entry.records = append(entry.records, answer)
+	}
+	sortRecords(entry.records)
+	for _, record := range entry.records {
+		entry.addrs = append(entry.addrs, describeRecord(record))
+	}
+	return entry
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of the address
+func reverseName(addr string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return "", errors.Errorf("invalid address '%s'", addr)
+	}
+	labels := []string{}
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip4[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa", nil
+	}
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x.%x", ip[i]&0x0f, ip[i]>>4))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa", nil
+}
+
+// recordKey is where record lookups are cached, next to the host lookups
+func recordKey(name string, qtype uint16) string {
+	return name + " " + recordTypeNames[qtype]
+}
+
+// describeRecord writes the record like a zone file would, so changes can be
+// reported the same way as address changes
+func describeRecord(record dnsAnswer) string {
+	switch record.Type {
+	case dnsTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, record.Value)
+	case dnsTypeMX:
+		return fmt.Sprintf("%d %s", record.Priority, record.Value)
+	}
+	return record.Value
+}
+
+func sortRecords(records []dnsAnswer) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Port < b.Port
+	})
+}
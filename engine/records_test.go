@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverLookupRecords(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"_sip._tcp.example.com/33": {
+			{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, TTL: 300, Value: "sip2.example.com", Priority: 10, Weight: 20, Port: 5060},
+			{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, TTL: 120, Value: "sip1.example.com", Priority: 10, Weight: 60, Port: 5060},
+			{Name: "_sip._tcp.example.com", Type: dnsTypeSRV, TTL: 300, Value: "backup.example.com", Priority: 20, Weight: 0, Port: 5080},
+		},
+		"example.com/15": {
+			{Name: "example.com", Type: dnsTypeMX, TTL: 300, Value: "mx2.example.com", Priority: 20},
+			{Name: "example.com", Type: dnsTypeMX, TTL: 300, Value: "mx1.example.com", Priority: 10},
+		},
+		"example.com/16": {
+			{Name: "example.com", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 -all"},
+			{Name: "example.com", Type: dnsTypeTXT, TTL: 300, Value: "google-site-verification=abc"},
+		},
+		"www.example.com/5": {
+			{Name: "www.example.com", Type: dnsTypeCNAME, TTL: 300, Value: "edge.example.net"},
+		},
+		"edge.example.net/5": {
+			{Name: "edge.example.net", Type: dnsTypeCNAME, TTL: 300, Value: "pop.example.org"},
+		},
+		"pop.example.org/5": {},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	srv, err := resolver.LookupSRV("_sip._tcp.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []SRVRecord{
+		{"sip1.example.com", 5060, 10, 60},
+		{"sip2.example.com", 5060, 10, 20},
+		{"backup.example.com", 5080, 20, 0},
+	}, srv, "srv records do not match")
+
+	entry := resolver.hosts["_sip._tcp.example.com SRV"]
+	assert.Equal(t, 120*time.Second, entry.ttl, "ttl does not match")
+	assert.Equal(t, "10 60 5060 sip1.example.com", entry.addrs[0], "description does not match")
+
+	mx, err := resolver.LookupMX("example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []MXRecord{{"mx1.example.com", 10}, {"mx2.example.com", 20}}, mx, "mx records do not match")
+
+	txt, err := resolver.LookupTXT("example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"google-site-verification=abc", "v=spf1 -all"}, txt, "txt records do not match")
+
+	cname, err := resolver.LookupCNAME("www.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "pop.example.org", cname, "canonical name does not match")
+
+	_, err = resolver.LookupMX("missing.example.com")
+	assert.Error(t, err, "expected an error")
+
+	hosts := resolver.Hosts()
+	assert.Equal(t, "_sip._tcp.example.com SRV", hosts[0].Host, "host does not match")
+}
+
+func TestResolverRefreshRecords(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"example.com/15": {
+			{Name: "example.com", Type: dnsTypeMX, TTL: 300, Value: "mx3.example.com", Priority: 10},
+		},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+	resolver.hosts["example.com MX"] = &hostEntry{
+		name:     "example.com",
+		qtype:    dnsTypeMX,
+		addrs:    []string{"10 mx1.example.com"},
+		ttl:      time.Minute,
+		resolved: time.Now().Add(-2 * time.Minute),
+	}
+
+	changes := resolver.Refresh()
+	assert.Equal(t, []HostChange{{"example.com MX", []string{"10 mx1.example.com"}, []string{"10 mx3.example.com"}}}, changes)
+}
+
+func TestResolverLookupAddr(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"3.2.0.192.in-addr.arpa/12": {
+			{Name: "3.2.0.192.in-addr.arpa", Type: dnsTypePTR, TTL: 300, Value: "cdn-edge-3.example.net"},
+		},
+		"3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa/12": {
+			{Name: "3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", Type: dnsTypePTR, TTL: 300, Value: "cdn-edge-3.example.net"},
+		},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	names, err := resolver.LookupAddr("192.0.2.3")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"cdn-edge-3.example.net"}, names, "names do not match")
+	assert.Contains(t, resolver.hosts, "3.2.0.192.in-addr.arpa PTR", "expected a cached lookup")
+
+	names, err = resolver.LookupAddr("2001:db8::3")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"cdn-edge-3.example.net"}, names, "names do not match")
+
+	_, err = resolver.LookupAddr("192.0.2.4")
+	assert.Error(t, err, "expected an error")
+
+	_, err = resolver.LookupAddr("cdn-edge-3.example.net")
+	assert.Error(t, err, "expected an error")
+}
@@ -0,0 +1,392 @@
+package engine
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// DefaultTTL is how long a lookup is remembered when there is no DNS TTL to go
+// by, like for hosts found by the system resolver
+const DefaultTTL = 5 * time.Minute
+
+// RetryBackoff is how long a lookup that failed for a reason other than the
+// name not existing, like a timeout, waits before it is tried again. The wait
+// doubles with every failure, up to DefaultTTL.
+const RetryBackoff = 10 * time.Second
+
+// HostChange describes how the addresses of a host changed on a refresh
+type HostChange struct {
+	Host     string
+	Previous []string
+	Current  []string
+}
+
+// HostStatus describes a cached lookup
+type HostStatus struct {
+	Host    string    `json:"host"`
+	Addrs   []string  `json:"addrs"`
+	Error   string    `json:"error,omitempty"`
+	Static  bool      `json:"static"`
+	Expires time.Time `json:"expires"`
+}
+
+type hostEntry struct {
+	// name and qtype are set for record lookups, like SRV or MX
+	name    string
+	qtype   uint16
+	records []dnsAnswer
+	addrs   []string
+	// cnames are the aliases followed to find the addresses of a host
+	cnames []string
+	err    error
+	// transient is set when err may go away, like a timeout or SERVFAIL,
+	// unlike a name that does not exist
+	transient bool
+	// partial is set when some of the queries failed that way
+	partial  bool
+	failures int
+	ttl      time.Duration
+	resolved time.Time
+	static   bool
+}
+
+// canonical returns the name at the end of the aliases of the host
+func (e *hostEntry) canonical(host string) string {
+	if len(e.cnames) == 0 {
+		return host
+	}
+	return e.cnames[len(e.cnames)-1]
+}
+
+func (e *hostEntry) expires() time.Time {
+	return e.resolved.Add(e.ttl)
+}
+
+func (e *hostEntry) expired(now time.Time) bool {
+	return !e.static && !now.Before(e.expires())
+}
+
+// Resolver looks up the hosts used by a template and remembers the results
+// until their DNS TTL runs out, so the template can be rendered again without
+// new lookups and refreshed when the records expire
+type Resolver struct {
+	mutex  sync.Mutex
+	client *dnsClient
+	// system finds the addresses of hosts the way every other program on the
+	// host does, going by nsswitch, /etc/hosts and the search domains
+	system func(host string) ([]string, error)
+	hosts  map[string]*hostEntry
+}
+
+var defaultResolver = NewResolver()
+
+// counted across every resolver, so the totals survive a template reload
+var dnsLookups, dnsFailures uint64
+
+// LookupStats returns how many host lookups were made and how many of them
+// failed since we started
+func LookupStats() (lookups uint64, failures uint64) {
+	return atomic.LoadUint64(&dnsLookups), atomic.LoadUint64(&dnsFailures)
+}
+
+// NewResolver returns a resolver with an empty cache
+func NewResolver() *Resolver {
+	return &Resolver{
+		client: newDNSClient(),
+		system: net.LookupHost,
+		hosts:  make(map[string]*hostEntry),
+	}
+}
+
+// FuncMap returns the template lookup functions backed by this resolver
+func (r *Resolver) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"lookupHosts":    r.LookupHosts,
+		"lookupIPv4Host": r.LookupIPv4Host,
+		"lookupIPv6Host": r.LookupIPv6Host,
+		"lookupSRV":      r.LookupSRV,
+		"lookupMX":       r.LookupMX,
+		"lookupTXT":      r.LookupTXT,
+		"lookupCNAME":    r.LookupCNAME,
+		"lookupAddr":     r.LookupAddr,
+		"spfAddrs":       r.SPFAddrs,
+	}
+}
+
+// LookupHost returns the sorted addresses of the host, using the cached
+// result until it expires
+func (r *Resolver) LookupHost(host string) ([]string, error) {
+	entry := r.lookupHost(host)
+	return entry.addrs, entry.err
+}
+
+// LookupHosts returns a list of HostInfo objects
+func (r *Resolver) LookupHosts(hosts []interface{}) []HostInfo {
+	host4Info := []HostInfo{}
+	host6Info := []HostInfo{}
+	for _, host := range hosts {
+		name := host.(string)
+		entry := r.lookupHost(name)
+		for _, addr := range entry.addrs {
+			info := HostInfo{
+				Addr:      addr,
+				Name:      name,
+				Canonical: entry.canonical(name),
+				CNAMEs:    entry.cnames,
+				TTL:       int(entry.ttl / time.Second),
+				Resolved:  entry.resolved,
+			}
+			if IsValidIPv4(addr) {
+				info.Type = "4"
+				host4Info = append(host4Info, info)
+			} else if IsValidIPv6(addr) {
+				info.Type = "6"
+				host6Info = append(host6Info, info)
+			}
+		}
+	}
+	return append(host4Info, host6Info...)
+}
+
+func (r *Resolver) lookupHost(host string) *hostEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.hosts[host]
+	if !ok || entry.expired(time.Now()) {
+		entry = keepOnFailure(entry, r.resolve(host))
+		r.hosts[host] = entry
+	}
+	return entry
+}
+
+// LookupIPv4Host returns a list of the given host's IPv4 addresses
+func (r *Resolver) LookupIPv4Host(host string) ([]string, error) {
+	addrs, err := r.LookupHost(host)
+	if err != nil {
+		return []string{}, err
+	}
+
+	ipv4Addrs := []string{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip.To4() != nil {
+			ipv4Addrs = append(ipv4Addrs, addr)
+		}
+	}
+	return ipv4Addrs, err
+}
+
+// LookupIPv6Host returns a list of the given host's IPv6 addresses
+func (r *Resolver) LookupIPv6Host(host string) ([]string, error) {
+	addrs, err := r.LookupHost(host)
+	if err != nil {
+		return []string{}, err
+	}
+
+	ipv6Addrs := []string{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip.To4() == nil {
+			ipv6Addrs = append(ipv6Addrs, addr)
+		}
+	}
+	return ipv6Addrs, err
+}
+
+// Refresh looks up every host whose records have expired again and returns
+// the hosts whose addresses changed
+func (r *Resolver) Refresh() []HostChange {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	changes := []HostChange{}
+	for host, entry := range r.hosts {
+		if !entry.expired(now) {
+			continue
+		}
+		var fresh *hostEntry
+		if entry.qtype != 0 {
+			fresh = r.resolveRecords(entry.name, entry.qtype)
+		} else {
+			fresh = r.resolve(host)
+		}
+		fresh = keepOnFailure(entry, fresh)
+		r.hosts[host] = fresh
+		if !equalAddrs(entry.addrs, fresh.addrs) {
+			changes = append(changes, HostChange{host, entry.addrs, fresh.addrs})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Host < changes[j].Host
+	})
+	return changes
+}
+
+// NextExpiry returns when the first cached lookup expires, false is returned
+// if none of the lookups expire
+func (r *Resolver) NextExpiry() (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var next time.Time
+	found := false
+	for _, entry := range r.hosts {
+		if entry.static {
+			continue
+		}
+		if !found || entry.expires().Before(next) {
+			next = entry.expires()
+			found = true
+		}
+	}
+	return next, found
+}
+
+// Hosts returns the cached lookups sorted by host
+func (r *Resolver) Hosts() []HostStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hosts := []HostStatus{}
+	for host, entry := range r.hosts {
+		status := HostStatus{Host: host, Addrs: entry.addrs, Static: entry.static}
+		if entry.err != nil {
+			status.Error = entry.err.Error()
+		}
+		if !entry.static {
+			status.Expires = entry.expires()
+		}
+		hosts = append(hosts, status)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+func (r *Resolver) resolve(host string) *hostEntry {
+	entry := &hostEntry{resolved: time.Now(), addrs: []string{}, cnames: []string{}}
+	if ip := net.ParseIP(host); ip != nil {
+		// addresses never change, no need to look them up again
+		entry.addrs = []string{ip.String()}
+		entry.static = true
+		return entry
+	}
+
+	atomic.AddUint64(&dnsLookups, 1)
+	entry.ttl = DefaultTTL
+	addrs, err := r.system(host)
+	if err != nil {
+		entry.err = err
+		dnsErr, ok := err.(*net.DNSError)
+		entry.transient = !ok || !dnsErr.IsNotFound
+		atomic.AddUint64(&dnsFailures, 1)
+		return entry
+	}
+	entry.addrs = append(entry.addrs, addrs...)
+	sort.Strings(entry.addrs)
+	r.addTTL(host, entry)
+	return entry
+}
+
+// addTTL asks the name servers for the records of the host, since the system
+// resolver does not report TTLs. Their TTL and aliases are only used when
+// they agree with the system resolver, a host pinned in /etc/hosts or found
+// through a search domain keeps DefaultTTL.
+func (r *Resolver) addTTL(host string, entry *hostEntry) {
+	var ttl uint32
+	first := true
+	failed := false
+	addrs := []string{}
+	cnames := []string{}
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := r.client.query(host, qtype)
+		if err != nil {
+			failed = failed || err != errDNSNotFound
+			continue
+		}
+		for _, answer := range answers {
+			if first || answer.TTL < ttl {
+				ttl = answer.TTL
+				first = false
+			}
+			if answer.Type == qtype {
+				addrs = append(addrs, answer.Value)
+			}
+		}
+		if len(cnames) == 0 {
+			cnames = cnameChain(host, answers)
+		}
+	}
+
+	sort.Strings(addrs)
+	if len(addrs) == 0 || !equalAddrs(addrs, entry.addrs) {
+		return
+	}
+	entry.ttl = time.Duration(ttl) * time.Second
+	entry.cnames = cnames
+	// the system resolver hides a failed query when the other one answered
+	entry.partial = failed
+}
+
+// cnameChain returns the aliases the answers followed from the host, in order
+func cnameChain(host string, answers []dnsAnswer) []string {
+	aliases := make(map[string]string)
+	for _, answer := range answers {
+		if answer.Type == dnsTypeCNAME {
+			aliases[strings.ToLower(answer.Name)] = answer.Value
+		}
+	}
+	chain := []string{}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for len(chain) < maxCNAMEHops {
+		alias, ok := aliases[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, alias)
+		name = strings.ToLower(alias)
+	}
+	return chain
+}
+
+// keepOnFailure returns the fresh lookup, unless it failed for a reason that
+// may go away. Then the previous addresses are kept, so a DNS outage does not
+// drop hosts from the rules, and the lookup is tried again after a backoff.
+func keepOnFailure(previous *hostEntry, fresh *hostEntry) *hostEntry {
+	failed := (fresh.err != nil && fresh.transient) || fresh.partial
+	if previous == nil || !failed || previous.static {
+		return fresh
+	}
+	kept := *previous
+	kept.err = fresh.err
+	kept.transient = fresh.transient
+	kept.failures = previous.failures + 1
+	kept.resolved = fresh.resolved
+	kept.ttl = RetryBackoff << uint(kept.failures-1)
+	if kept.failures > 8 || kept.ttl > DefaultTTL {
+		kept.ttl = DefaultTTL
+	}
+	return &kept
+}
+
+func equalAddrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
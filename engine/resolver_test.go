@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverCachesLookups(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"www.example.com/1": {
+			{Name: "www.example.com", Type: dnsTypeA, TTL: 300, Value: "192.0.2.20"},
+			{Name: "www.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.10"},
+		},
+		"www.example.com/28": {},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	addrs, err := resolver.LookupHost("www.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"192.0.2.10", "192.0.2.20"}, addrs, "addresses do not match")
+
+	entry := resolver.hosts["www.example.com"]
+	assert.Equal(t, 60*time.Second, entry.ttl, "ttl does not match")
+
+	expiry, found := resolver.NextExpiry()
+	assert.True(t, found, "expected an expiry")
+	assert.Equal(t, entry.expires(), expiry, "expiry does not match")
+}
+
+func TestResolverStaticAddress(t *testing.T) {
+	resolver := NewResolver()
+	addrs, err := resolver.LookupHost("2001:db8:0::1")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"2001:db8::1"}, addrs, "addresses do not match")
+
+	hosts := resolver.Hosts()
+	assert.Len(t, hosts, 1, "unexpected hosts")
+	assert.Equal(t, "2001:db8:0::1", hosts[0].Host, "host does not match")
+	assert.True(t, hosts[0].Static, "expected a static host")
+
+	_, found := resolver.NextExpiry()
+	assert.False(t, found, "addresses should never expire")
+}
+
+func TestResolverRefresh(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"www.example.com/1": {
+			{Name: "www.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.30"},
+		},
+		"www.example.com/28": {},
+		"api.example.com/1": {
+			{Name: "api.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.40"},
+		},
+		"api.example.com/28": {},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+	resolver.hosts["www.example.com"] = &hostEntry{
+		addrs:    []string{"192.0.2.10"},
+		ttl:      time.Minute,
+		resolved: time.Now().Add(-2 * time.Minute),
+	}
+	resolver.hosts["api.example.com"] = &hostEntry{
+		addrs:    []string{"192.0.2.40"},
+		ttl:      time.Minute,
+		resolved: time.Now().Add(-2 * time.Minute),
+	}
+
+	changes := resolver.Refresh()
+	assert.Equal(t, []HostChange{{"www.example.com", []string{"192.0.2.10"}, []string{"192.0.2.30"}}}, changes)
+}
+
+func TestResolverLookupHostsInfo(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"www.example.com/1": {
+			{Name: "www.example.com", Type: dnsTypeCNAME, TTL: 3600, Value: "cdn.example.net"},
+			{Name: "cdn.example.net", Type: dnsTypeCNAME, TTL: 600, Value: "cdn-edge-3.example.net"},
+			{Name: "cdn-edge-3.example.net", Type: dnsTypeA, TTL: 300, Value: "192.0.2.3"},
+		},
+		"www.example.com/28": {
+			{Name: "www.example.com", Type: dnsTypeCNAME, TTL: 3600, Value: "cdn.example.net"},
+			{Name: "cdn.example.net", Type: dnsTypeCNAME, TTL: 600, Value: "cdn-edge-3.example.net"},
+			{Name: "cdn-edge-3.example.net", Type: dnsTypeAAAA, TTL: 300, Value: "2001:db8::3"},
+		},
+		"mail.example.com/1": {
+			{Name: "mail.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.25"},
+		},
+		"mail.example.com/28": {},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	hosts := resolver.LookupHosts([]interface{}{"www.example.com", "mail.example.com"})
+	assert.Len(t, hosts, 3, "unexpected hosts")
+
+	edge := hosts[0]
+	assert.Equal(t, "4", edge.Type, "type does not match")
+	assert.Equal(t, "192.0.2.3", edge.Addr, "address does not match")
+	assert.Equal(t, "www.example.com", edge.Name, "name does not match")
+	assert.Equal(t, "cdn-edge-3.example.net", edge.Canonical, "canonical name does not match")
+	assert.Equal(t, []string{"cdn.example.net", "cdn-edge-3.example.net"}, edge.CNAMEs, "aliases do not match")
+	assert.Equal(t, 300, edge.TTL, "ttl does not match")
+	assert.Equal(t, resolver.hosts["www.example.com"].resolved, edge.Resolved, "resolve time does not match")
+
+	mail := hosts[1]
+	assert.Equal(t, "mail.example.com", mail.Canonical, "canonical name does not match")
+	assert.Empty(t, mail.CNAMEs, "expected no aliases")
+	assert.Equal(t, 60, mail.TTL, "ttl does not match")
+
+	assert.Equal(t, "6", hosts[2].Type, "type does not match")
+	assert.Equal(t, "cdn-edge-3.example.net", hosts[2].Canonical, "canonical name does not match")
+}
+
+func TestResolverRefreshKeepsAddrsOnFailure(t *testing.T) {
+	records := map[string][]dnsAnswer{
+		"www.example.com/1": {
+			{Name: "www.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.30"},
+		},
+		"www.example.com/28": {
+			{Name: "www.example.com", Type: dnsTypeAAAA, TTL: 60, Value: "2001:db8::30"},
+		},
+		"example.com/15": {
+			{Name: "example.com", Type: dnsTypeMX, TTL: 60, Value: "mx1.example.com", Priority: 10},
+		},
+	}
+	client, stop := startTestDNSServer(t, records)
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+	addrs, err := resolver.LookupHost("www.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"192.0.2.30", "2001:db8::30"}, addrs, "addresses do not match")
+	_, err = resolver.LookupMX("example.com")
+	assert.NoError(t, err, "unexpected error")
+
+	expire := func() {
+		for _, entry := range resolver.hosts {
+			entry.resolved = time.Now().Add(-time.Hour)
+		}
+	}
+
+	// the servers fail, the hosts keep their addresses
+	records["www.example.com/1"] = nil
+	records["www.example.com/28"] = nil
+	records["example.com/15"] = nil
+	expire()
+	assert.Empty(t, resolver.Refresh(), "failed lookups should not change hosts")
+	entry := resolver.hosts["www.example.com"]
+	assert.Equal(t, []string{"192.0.2.30", "2001:db8::30"}, entry.addrs, "addresses should be kept")
+	assert.Error(t, entry.err, "expected the failure to be remembered")
+	assert.Equal(t, RetryBackoff, entry.ttl, "expected a retry backoff")
+	mx, err := resolver.LookupMX("example.com")
+	assert.Error(t, err, "expected an error")
+	assert.Equal(t, []MXRecord{{"mx1.example.com", 10}}, mx, "records should be kept")
+
+	expire()
+	resolver.Refresh()
+	assert.Equal(t, 2*RetryBackoff, resolver.hosts["www.example.com"].ttl, "expected a longer backoff")
+
+	// only the IPv6 lookup fails
+	records["www.example.com/1"] = []dnsAnswer{
+		{Name: "www.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.31"},
+	}
+	expire()
+	assert.Empty(t, resolver.Refresh(), "partial lookups should not change hosts")
+	assert.Equal(t, []string{"192.0.2.30", "2001:db8::30"}, resolver.hosts["www.example.com"].addrs,
+		"addresses should be kept")
+
+	// the name is gone, which is a change
+	delete(records, "www.example.com/1")
+	delete(records, "www.example.com/28")
+	expire()
+	changes := resolver.Refresh()
+	assert.Equal(t, []HostChange{{"www.example.com", []string{"192.0.2.30", "2001:db8::30"}, []string{}}}, changes)
+}
+
+func TestResolverPrefersSystemResolver(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"pinned.example.com/1": {
+			{Name: "pinned.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.30"},
+		},
+		"pinned.example.com/28": {},
+		"db.corp.example.com/1": {
+			{Name: "db.corp.example.com", Type: dnsTypeA, TTL: 60, Value: "192.0.2.40"},
+		},
+		"db.corp.example.com/28": {},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	resolver.client = client
+	resolver.system = func(host string) ([]string, error) {
+		switch host {
+		case "pinned.example.com":
+			// pinned in /etc/hosts
+			return []string{"10.0.0.5"}, nil
+		case "db":
+			// found through the search domain corp.example.com
+			return []string{"192.0.2.40"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	addrs, err := resolver.LookupHost("pinned.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"10.0.0.5"}, addrs, "/etc/hosts should win over DNS")
+	assert.Equal(t, DefaultTTL, resolver.hosts["pinned.example.com"].ttl, "ttl does not match")
+
+	addrs, err = resolver.LookupHost("db")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{"192.0.2.40"}, addrs, "search domains should be used")
+	assert.Equal(t, DefaultTTL, resolver.hosts["db"].ttl, "ttl does not match")
+}
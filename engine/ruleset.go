@@ -2,6 +2,8 @@ package engine
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -22,15 +24,42 @@ var Version string
 // Import depth prevents an infinite loop of imports
 const DefaultMaxImportDepth = 100
 
+// Options change how a template is read
+type Options struct {
+	// Provenance is the comment added to every rule, {file} and {line} are
+	// replaced with where the rule came from. Empty leaves the rules alone.
+	Provenance string
+	// CloudRanges overrides where the ip ranges of a cloud provider (aws, gcp
+	// or azure) are read from, with a file path or a URL
+	CloudRanges map[string]string
+	// CacheDir keeps downloaded cloud ip ranges, empty downloads them on
+	// every load
+	CacheDir string
+	// CacheTTL is how long downloaded ip ranges are used, the default is
+	// DefaultCloudCacheTTL
+	CacheTTL time.Duration
+}
+
 type RuleSet struct {
 	template       *template.Template
 	vars           map[string]interface{}
 	templatePath   string
 	maxImportDepth uint
+	resolver       *Resolver
+	imports        []string
+	dataFiles      []string
+	clouds         map[string]*cloudDocument
+	options        Options
 }
 
 func NewRuleset(templatePath string) (*RuleSet, error) {
+	return NewRulesetWithOptions(templatePath, Options{})
+}
+
+// NewRulesetWithOptions reads the template like NewRuleset, with options
+func NewRulesetWithOptions(templatePath string, options Options) (*RuleSet, error) {
 	ruleset := new(RuleSet)
+	ruleset.options = options
 
 	templateBytes, err := ruleset.readTemplateFile(templatePath)
 	if err != nil {
@@ -38,13 +67,24 @@ func NewRuleset(templatePath string) (*RuleSet, error) {
 	}
 	ruleset.templatePath = templatePath
 	ruleset.maxImportDepth = DefaultMaxImportDepth
+	ruleset.resolver = NewResolver()
 
+	templateBytes = ruleset.annotateRules(templateBytes, templatePath)
 	expandedBytes, err := ruleset.expandImports(templateBytes, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	rulesetBytes, vars, err := ruleset.extractVars(expandedBytes)
+	if err != nil {
+		return nil, err
+	}
 	ruleset.vars = vars
 
-	ruleset.template = template.Must(template.New("rules").Funcs(NetFuncs()).Parse(string(rulesetBytes)))
+	ruleset.template, err = template.New("rules").Funcs(NetFuncs()).Funcs(ruleset.resolver.FuncMap()).Funcs(ruleset.FuncMap()).Parse(string(rulesetBytes))
+	if err != nil {
+		return nil, errors.Wrapf(err, "template error")
+	}
 
 	return ruleset, nil
 }
@@ -53,6 +93,51 @@ func (r *RuleSet) SetImportDepth(newDepth uint) {
 	r.maxImportDepth = newDepth
 }
 
+// Resolver returns the resolver used for the lookups in this ruleset. The
+// lookups are cached, so the rules can be generated again without touching
+// DNS until the resolver is refreshed.
+func (r *RuleSet) Resolver() *Resolver {
+	return r.resolver
+}
+
+// FuncMap returns the template functions that read files next to the template
+func (r *RuleSet) FuncMap() template.FuncMap {
+	return template.FuncMap{
+		"readList": r.ReadList,
+		"loadYAML": r.LoadYAML,
+		"loadJSON": r.LoadJSON,
+		"loadCSV":  r.LoadCSV,
+
+		"awsRanges":   r.AWSRanges,
+		"gcpRanges":   r.GCPRanges,
+		"azureRanges": r.AzureRanges,
+	}
+}
+
+// Files returns the template, every file its imports currently match and the
+// files read by the last render, so files added to an imported directory are
+// included
+func (r *RuleSet) Files() []string {
+	files := []string{r.templatePath}
+	seen := map[string]bool{r.templatePath: true}
+	for _, importPath := range r.imports {
+		importFiles, _ := r.getFileList(importPath)
+		for _, filePath := range importFiles {
+			if !seen[filePath] {
+				seen[filePath] = true
+				files = append(files, filePath)
+			}
+		}
+	}
+	for _, filePath := range r.dataFiles {
+		if !seen[filePath] {
+			seen[filePath] = true
+			files = append(files, filePath)
+		}
+	}
+	return files
+}
+
 func (r *RuleSet) GenerateRules(appVersion string) ([]byte, error) {
 	t := time.Now()
 	header := fmt.Sprintf("# Generated by %s on %s\n", appVersion, t.Format("2006/01/02 15:04:05 -700"))
@@ -67,6 +152,18 @@ func (r *RuleSet) GenerateRules(appVersion string) ([]byte, error) {
 	return msgBuffer.Bytes(), nil
 }
 
+// RulesHash returns a hash of generated rules that leaves out the generated
+// header, so the same rules always hash the same
+func RulesHash(rules []byte) string {
+	if bytes.HasPrefix(rules, []byte("# Generated by ")) {
+		if i := bytes.IndexByte(rules, '\n'); i >= 0 {
+			rules = rules[i+1:]
+		}
+	}
+	sum := sha256.Sum256(rules)
+	return hex.EncodeToString(sum[:])
+}
+
 func (r *RuleSet) readTemplateFile(templatePath string) ([]byte, error) {
 	if _, err := os.Stat(templatePath); os.IsNotExist(err) {
 		return nil, errors.Wrapf(err, "open template")
@@ -129,6 +226,7 @@ func (r *RuleSet) expandImports(ruleset []byte, depth uint) ([]byte, error) {
 			continue
 		}
 		importPath := string(bytes.TrimSpace(parts[1]))
+		r.imports = append(r.imports, importPath)
 
 		if depth < r.maxImportDepth {
 			importPaths, err := r.getFileList(importPath)
@@ -141,6 +239,7 @@ func (r *RuleSet) expandImports(ruleset []byte, depth uint) ([]byte, error) {
 				if err != nil {
 					return nil, errors.Wrapf(err, "could not read '%s'", filePath)
 				}
+				fileBytes = r.annotateRules(fileBytes, filePath)
 
 				fileRules, err := r.expandImports(fileBytes, depth+1)
 				if err != nil {
@@ -245,6 +245,46 @@ func TestDirectoryList(t *testing.T) {
 	}
 }
 
+func TestFilesIncludesNewImports(t *testing.T) {
+	importDirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(importDirPath) // clean up
+
+	rulesFilePath := path.Join(importDirPath, "rules.yml")
+	err = ioutil.WriteFile(rulesFilePath, []byte(`{@ conf.d/*.tr @}`), 0644)
+	assert.NoError(t, err, "test file write error")
+	err = os.Mkdir(path.Join(importDirPath, "conf.d"), 0755)
+	assert.NoError(t, err, "failed to make dir")
+	importFilePath := path.Join(importDirPath, "conf.d", "one.tr")
+	err = ioutil.WriteFile(importFilePath, []byte(`one`), 0644)
+	assert.NoError(t, err, "test file write error")
+
+	ruleset, err := NewRuleset(rulesFilePath)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []string{rulesFilePath, importFilePath}, ruleset.Files())
+
+	newFilePath := path.Join(importDirPath, "conf.d", "two.tr")
+	err = ioutil.WriteFile(newFilePath, []byte(`two`), 0644)
+	assert.NoError(t, err, "test file write error")
+	assert.Equal(t, []string{rulesFilePath, importFilePath, newFilePath}, ruleset.Files())
+}
+
+func TestNewRulesetWithBadTemplate(t *testing.T) {
+	rulesFilePath, err := writeTempFile([]byte(`{{ if }}`))
+	assert.NoError(t, err, "test file write error")
+	defer os.Remove(rulesFilePath) // clean up
+
+	_, err = NewRuleset(rulesFilePath)
+	assert.Error(t, err, "expected an error")
+}
+
+func TestRulesHashIgnoresHeader(t *testing.T) {
+	first := RulesHash([]byte("# Generated by templr on 2017/01/01 00:00:00 +0000\n*filter\nCOMMIT\n"))
+	second := RulesHash([]byte("# Generated by templr on 2018/01/01 00:00:00 +0000\n*filter\nCOMMIT\n"))
+	assert.Equal(t, first, second, "hashes do not match")
+	assert.NotEqual(t, first, RulesHash([]byte("*nat\nCOMMIT\n")), "hashes should not match")
+}
+
 func writeTempFile(contents []byte) (name string, err error) {
 	fileObj, err := ioutil.TempFile(os.TempDir(), "templr-test")
 	if err != nil {
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSPFLookups is how many mechanisms that need a DNS lookup one SPF check
+// may use, see RFC 7208 section 4.6.4
+const maxSPFLookups = 10
+
+// SPFAddrs returns the addresses and CIDR ranges that the SPF record of the
+// domain allows to send mail, following include, redirect, a and mx. Only
+// mechanisms that pass are followed, and each address is listed once.
+func (r *Resolver) SPFAddrs(domain string) ([]HostInfo, error) {
+	walk := &spfWalk{resolver: r, seen: make(map[string]bool), visited: make(map[string]bool)}
+	if err := walk.domain(strings.ToLower(strings.TrimSuffix(domain, "."))); err != nil {
+		return []HostInfo{}, errors.Wrapf(err, "spf %s", domain)
+	}
+	return append(walk.ipv4, walk.ipv6...), nil
+}
+
+type spfWalk struct {
+	resolver *Resolver
+	lookups  int
+	visited  map[string]bool
+	seen     map[string]bool
+	ipv4     []HostInfo
+	ipv6     []HostInfo
+}
+
+func (w *spfWalk) domain(domain string) error {
+	if w.visited[domain] {
+		// already added, this also stops include loops
+		return nil
+	}
+	w.visited[domain] = true
+
+	record, err := w.record(domain)
+	if err != nil {
+		return err
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		term = strings.ToLower(term)
+		if strings.HasPrefix(term, "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		if strings.Contains(term, "=") {
+			// other modifiers, like exp=
+			continue
+		}
+
+		qualifier := "+"
+		if strings.IndexAny(term[:1], "+-~?") == 0 {
+			qualifier, term = term[:1], term[1:]
+		}
+		name, value := term, ""
+		if i := strings.IndexAny(term, ":/"); i >= 0 {
+			name, value = term[:i], strings.TrimPrefix(term[i:], ":")
+		}
+
+		switch name {
+		case "include", "a", "mx", "ptr", "exists":
+			if err = w.countLookup(); err != nil {
+				return err
+			}
+		}
+		if qualifier != "+" {
+			continue
+		}
+
+		switch name {
+		case "ip4", "ip6":
+			err = w.add(value, domain)
+		case "include":
+			if err = checkSPFDomain(value); err == nil {
+				err = w.domain(value)
+			}
+		case "a":
+			err = w.addHost(value, domain)
+		case "mx":
+			err = w.addMX(value, domain)
+		case "all", "ptr", "exists":
+			// nothing to expand
+		default:
+			err = errors.Errorf("unknown mechanism '%s' in %s", term, domain)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(redirect) > 0 {
+		if err = w.countLookup(); err != nil {
+			return err
+		}
+		if err = checkSPFDomain(redirect); err != nil {
+			return err
+		}
+		return w.domain(redirect)
+	}
+	return nil
+}
+
+// record returns the SPF record of the domain
+func (w *spfWalk) record(domain string) (string, error) {
+	records, err := w.resolver.LookupTXT(domain)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, record := range records {
+		lower := strings.ToLower(record)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if len(found) > 0 {
+				return "", errors.Errorf("%s has more than one spf record", domain)
+			}
+			found = record
+		}
+	}
+	if len(found) == 0 {
+		return "", errors.Errorf("%s has no spf record", domain)
+	}
+	return found, nil
+}
+
+func (w *spfWalk) countLookup() error {
+	w.lookups++
+	if w.lookups > maxSPFLookups {
+		return errors.Errorf("more than %d dns lookups", maxSPFLookups)
+	}
+	return nil
+}
+
+// addHost adds the addresses of an a mechanism, like a, a:host or a:host/24
+func (w *spfWalk) addHost(value string, domain string) error {
+	host, ipv4Mask, ipv6Mask, err := splitSPFTarget(value, domain)
+	if err != nil {
+		return err
+	}
+	addrs, err := w.resolver.LookupHost(host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err = w.add(maskAddr(addr, ipv4Mask, ipv6Mask), domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMX adds the addresses of the mail servers of an mx mechanism
+func (w *spfWalk) addMX(value string, domain string) error {
+	host, ipv4Mask, ipv6Mask, err := splitSPFTarget(value, domain)
+	if err != nil {
+		return err
+	}
+	servers, err := w.resolver.LookupMX(host)
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		addrs, err := w.resolver.LookupHost(server.Host)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if err = w.add(maskAddr(addr, ipv4Mask, ipv6Mask), domain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *spfWalk) add(addr string, domain string) error {
+	canonical, err := IPCanonical(addr)
+	if err != nil {
+		return errors.Errorf("invalid address '%s' in %s", addr, domain)
+	}
+	if w.seen[canonical] {
+		return nil
+	}
+	w.seen[canonical] = true
+
+	family, _ := IPFamily(canonical)
+	if family == 4 {
+		w.ipv4 = append(w.ipv4, HostInfo{Type: "4", Addr: canonical, Name: domain})
+	} else {
+		w.ipv6 = append(w.ipv6, HostInfo{Type: "6", Addr: canonical, Name: domain})
+	}
+	return nil
+}
+
+// splitSPFTarget splits the domain and the masks out of an a or mx value,
+// like example.com/24//64
+func splitSPFTarget(value string, domain string) (string, int, int, error) {
+	host := domain
+	ipv4Mask, ipv6Mask := -1, -1
+
+	if i := strings.Index(value, "//"); i >= 0 {
+		mask, err := strconv.Atoi(value[i+2:])
+		if err != nil || mask < 0 || mask > 128 {
+			return "", 0, 0, errors.Errorf("invalid ip6 mask in '%s'", value)
+		}
+		ipv6Mask, value = mask, value[:i]
+	}
+	if i := strings.Index(value, "/"); i >= 0 {
+		mask, err := strconv.Atoi(value[i+1:])
+		if err != nil || mask < 0 || mask > 32 {
+			return "", 0, 0, errors.Errorf("invalid ip4 mask in '%s'", value)
+		}
+		ipv4Mask, value = mask, value[:i]
+	}
+	if len(value) > 0 {
+		host = value
+	}
+	return host, ipv4Mask, ipv6Mask, checkSPFDomain(host)
+}
+
+// checkSPFDomain rejects domains that use macros, which need the address of
+// the sender to expand
+func checkSPFDomain(domain string) error {
+	if len(domain) == 0 {
+		return errors.New("missing domain")
+	}
+	if strings.Contains(domain, "%") {
+		return errors.Errorf("macros are not supported in '%s'", domain)
+	}
+	return nil
+}
+
+// maskAddr turns the address into its network when a mask is given
+func maskAddr(addr string, ipv4Mask int, ipv6Mask int) string {
+	mask := ipv6Mask
+	if family, _ := IPFamily(addr); family == 4 {
+		mask = ipv4Mask
+	}
+	if mask < 0 {
+		return addr
+	}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil && mask <= 32 {
+		ip = ip4
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(mask, len(ip)*8)), Mask: net.CIDRMask(mask, len(ip)*8)}
+	return network.String()
+}
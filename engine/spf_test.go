@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolverSPFAddrs(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"example.com/16": {
+			{Name: "example.com", Type: dnsTypeTXT, TTL: 300, Value: "google-site-verification=abc"},
+			{Name: "example.com", Type: dnsTypeTXT, TTL: 300,
+				Value: "v=spf1 ip4:192.0.2.1 ip6:2001:DB8::/32 a mx/24 include:_spf.example.net -ip4:198.51.100.9 ~all"},
+		},
+		"example.com/1": {
+			{Name: "example.com", Type: dnsTypeA, TTL: 300, Value: "192.0.2.1"},
+		},
+		"example.com/28": {},
+		"example.com/15": {
+			{Name: "example.com", Type: dnsTypeMX, TTL: 300, Value: "mx.example.com", Priority: 10},
+		},
+		"mx.example.com/1": {
+			{Name: "mx.example.com", Type: dnsTypeA, TTL: 300, Value: "203.0.113.25"},
+		},
+		"mx.example.com/28": {},
+		"_spf.example.net/16": {
+			{Name: "_spf.example.net", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 ip4:198.51.100.0/24 include:example.com redirect=_spf2.example.net"},
+		},
+		"_spf2.example.net/16": {
+			{Name: "_spf2.example.net", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 ip6:2001:db8:1::1 -all"},
+		},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	addrs, err := resolver.SPFAddrs("example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []HostInfo{
+		{Type: "4", Addr: "192.0.2.1", Name: "example.com"},
+		{Type: "4", Addr: "203.0.113.0/24", Name: "example.com"},
+		{Type: "4", Addr: "198.51.100.0/24", Name: "_spf.example.net"},
+		{Type: "6", Addr: "2001:db8::/32", Name: "example.com"},
+		{Type: "6", Addr: "2001:db8:1::1", Name: "_spf2.example.net"},
+	}, addrs, "addresses do not match")
+}
+
+func TestResolverSPFAddrsLimit(t *testing.T) {
+	records := map[string][]dnsAnswer{}
+	// every domain includes the next one, one more than the limit allows
+	domains := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com",
+		"e.example.com", "f.example.com", "g.example.com", "h.example.com", "i.example.com",
+		"j.example.com", "k.example.com", "l.example.com"}
+	for i, domain := range domains[:len(domains)-1] {
+		records[domain+"/16"] = []dnsAnswer{
+			{Name: domain, Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 include:" + domains[i+1] + " -all"},
+		}
+	}
+	records["l.example.com/16"] = []dnsAnswer{
+		{Name: "l.example.com", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 ip4:192.0.2.1 -all"},
+	}
+	client, stop := startTestDNSServer(t, records)
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	_, err := resolver.SPFAddrs("a.example.com")
+	assert.Error(t, err, "expected an error")
+
+	addrs, err := resolver.SPFAddrs("c.example.com")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, []HostInfo{{Type: "4", Addr: "192.0.2.1", Name: "l.example.com"}}, addrs, "addresses do not match")
+}
+
+func TestResolverSPFAddrsErrors(t *testing.T) {
+	client, stop := startTestDNSServer(t, map[string][]dnsAnswer{
+		"none.example.com/16": {
+			{Name: "none.example.com", Type: dnsTypeTXT, TTL: 300, Value: "hello"},
+		},
+		"macro.example.com/16": {
+			{Name: "macro.example.com", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 include:%{i}._spf.example.com -all"},
+		},
+		"bad.example.com/16": {
+			{Name: "bad.example.com", Type: dnsTypeTXT, TTL: 300, Value: "v=spf1 ip4:rando -all"},
+		},
+	})
+	defer stop()
+
+	resolver := NewResolver()
+	useTestDNS(resolver, client)
+
+	for _, domain := range []string{"none.example.com", "macro.example.com", "bad.example.com", "missing.example.com"} {
+		_, err := resolver.SPFAddrs(domain)
+		assert.Error(t, err, "expected an error for %s", domain)
+	}
+}
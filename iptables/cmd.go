@@ -1,19 +1,31 @@
 package iptables
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 
 	sh "github.com/codeskyblue/go-sh"
+	"github.com/pkg/errors"
 )
 
-func getCleanupRules() []byte {
-	return []byte(`
-*filter
-:INPUT ACCEPT [0:0]
-:FORWARD ACCEPT [0:0]
-:OUTPUT ACCEPT [0:0]
-COMMIT
-`)
+// toolset holds the executables and paths used to manage a single ip family
+type toolset struct {
+	family      Family
+	tables      string
+	restore     string
+	save        string
+	persistPath string
+	tablesNames string
+}
+
+func ipv4Tools() toolset {
+	return toolset{IPv4, ip4tables, ip4tablesRestore, ip4tablesSave, ip4RulesPersistPath, ip4TablesNamesPath}
+}
+
+func ipv6Tools() toolset {
+	return toolset{IPv6, ip6tables, ip6tablesRestore, ip6tablesSave, ip6RulesPersistPath, ip6TablesNamesPath}
 }
 
 func Exists() bool {
@@ -24,30 +36,26 @@ func Exists() bool {
 }
 
 func LoadIPv4Rules(rules []byte, restoreCounters bool, persist bool) error {
-	rulesFile, err := getTempFile()
-	if err != nil {
-		return err
-	}
-	defer os.Remove(rulesFile.Name())
+	return loadRules(ipv4Tools(), rules, restoreCounters, persist)
+}
 
-	err = writeFile(rulesFile.Name(), rules)
-	if err != nil {
-		return err
-	}
+func LoadIPv6Rules(rules []byte, restoreCounters bool, persist bool) error {
+	return loadRules(ipv6Tools(), rules, restoreCounters, persist)
+}
 
+func loadRules(tools toolset, rules []byte, restoreCounters bool, persist bool) error {
 	var args []interface{}
 	if restoreCounters {
 		args = append(args, "-c")
 	}
-	args = append(args, rulesFile.Name())
 
-	err = sh.Command(ip4tablesRestore, args...).Run()
+	err := restoreRules(tools, rules, args...)
 	if err != nil {
 		return err
 	}
 
 	if persist {
-		err = persistIPv4Rules(rules)
+		err = persistRules(tools, rules)
 		if err != nil {
 			return err
 		}
@@ -56,11 +64,24 @@ func LoadIPv4Rules(rules []byte, restoreCounters bool, persist bool) error {
 	return nil
 }
 
-func LoadIPv6Rules(rules []byte, restoreCounters bool, persist bool) error {
+// TestIPv4Rules checks that iptables-restore accepts the IPv4 rules without
+// applying them
+func TestIPv4Rules(rules []byte) error {
+	return restoreRules(ipv4Tools(), rules, "--test")
+}
+
+// TestIPv6Rules checks that ip6tables-restore accepts the IPv6 rules without
+// applying them
+func TestIPv6Rules(rules []byte) error {
+	return restoreRules(ipv6Tools(), rules, "--test")
+}
+
+func restoreRules(tools toolset, rules []byte, args ...interface{}) error {
 	rulesFile, err := getTempFile()
 	if err != nil {
 		return err
 	}
+	rulesFile.Close()
 	defer os.Remove(rulesFile.Name())
 
 	err = writeFile(rulesFile.Name(), rules)
@@ -68,93 +89,212 @@ func LoadIPv6Rules(rules []byte, restoreCounters bool, persist bool) error {
 		return err
 	}
 
-	var args []interface{}
-	if restoreCounters {
-		args = append(args, "-c")
-	}
 	args = append(args, rulesFile.Name())
+	return sh.Command(tools.restore, args...).Run()
+}
+
+// PersistIPv4Rules saves the IPv4 rules to netfilter-persistent, so they are
+// loaded at boot
+func PersistIPv4Rules(rules []byte) error {
+	return persistRules(ipv4Tools(), rules)
+}
 
-	err = sh.Command(ip6tablesRestore, args...).Run()
+// PersistIPv6Rules saves the IPv6 rules to netfilter-persistent, so they are
+// loaded at boot
+func PersistIPv6Rules(rules []byte) error {
+	return persistRules(ipv6Tools(), rules)
+}
+
+func persistRules(tools toolset, rules []byte) error {
+	err := writeFile(tools.persistPath, rules)
 	if err != nil {
 		return err
 	}
+	return nil
+}
 
-	if persist {
-		err = persistIPv6Rules(rules)
-		if err != nil {
-			return err
-		}
+func saveRules(tools toolset) ([]byte, error) {
+	out, err := sh.Command(tools.save, "-c").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", path.Base(tools.save))
 	}
+	return out, nil
+}
 
-	return nil
+// GetIPv4Rules returns the live IPv4 rules, with their counters
+func GetIPv4Rules() (*Rules, error) {
+	return getLiveRules(ipv4Tools())
 }
 
-func persistIPv4Rules(rules []byte) error {
-	err := writeFile(ip4RulesPersistPath, rules)
+// GetIPv6Rules returns the live IPv6 rules, with their counters
+func GetIPv6Rules() (*Rules, error) {
+	return getLiveRules(ipv6Tools())
+}
+
+func getLiveRules(tools toolset) (*Rules, error) {
+	data, err := saveRules(tools)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return ParseRules(data, tools.family)
 }
 
-func persistIPv6Rules(rules []byte) error {
-	err := writeFile(ip6RulesPersistPath, rules)
-	if err != nil {
-		return err
+// ClearedTable reports what was removed from a table when it was cleared
+type ClearedTable struct {
+	Name   string
+	Rules  int
+	Chains []string
+}
+
+// ClearIPv4Rules resets every loaded IPv4 table to accept all traffic with no
+// rules or custom chains, and reports what was cleared
+func ClearIPv4Rules(persist bool) ([]ClearedTable, error) {
+	return clearRules(ipv4Tools(), persist)
+}
+
+// ClearIPv6Rules resets every loaded IPv6 table to accept all traffic with no
+// rules or custom chains, and reports what was cleared
+func ClearIPv6Rules(persist bool) ([]ClearedTable, error) {
+	return clearRules(ipv6Tools(), persist)
+}
+
+// UnloadIPv4Rules loads the IPv4 unload rules, then resets every other loaded
+// table to accept all traffic and reports what was cleared
+func UnloadIPv4Rules(rules []byte, persist bool) ([]ClearedTable, error) {
+	return unloadRules(ipv4Tools(), rules, persist)
+}
+
+// UnloadIPv6Rules loads the IPv6 unload rules, then resets every other loaded
+// table to accept all traffic and reports what was cleared
+func UnloadIPv6Rules(rules []byte, persist bool) ([]ClearedTable, error) {
+	return unloadRules(ipv6Tools(), rules, persist)
+}
+
+func clearRules(tools toolset, persist bool) ([]ClearedTable, error) {
+	cleared, cleanRules, errs := clearTables(tools, map[string]bool{})
+
+	if persist {
+		if err := persistRules(tools, cleanRules.Bytes()); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return nil
+
+	return cleared, errs.errOrNil()
 }
 
-func ClearIPv4Rules(persist bool) error {
-	// First set all chains to accept in case something funky happens
-	cleanRules := getCleanupRules()
-	err := LoadIPv4Rules(cleanRules, false, persist)
+func unloadRules(tools toolset, rules []byte, persist bool) ([]ClearedTable, error) {
+	parsed, err := ParseRules(rules, tools.family)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// flush the nat & mangle tables
-	sh.Command(ip4tables, "-t", "nat", "-F").Run()
-	sh.Command(ip4tables, "-t", "mangle", "-F").Run()
-	// flush all chains
-	sh.Command(ip4tables, "-F").Run()
-	// delete all non-default chains
-	sh.Command(ip4tables, "-X").Run()
+	// load the unload rules first so the host is never left wide open
+	if err = restoreRules(tools, rules); err != nil {
+		return nil, err
+	}
 
-	return nil
+	skip := map[string]bool{}
+	for _, table := range parsed.Tables {
+		skip[table.Name] = true
+	}
+	cleared, cleanRules, errs := clearTables(tools, skip)
+
+	if persist {
+		persistBytes := append(append([]byte{}, rules...), cleanRules.Bytes()...)
+		if err := persistRules(tools, persistBytes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return cleared, errs.errOrNil()
 }
 
-func ClearIPv6Rules(persist bool) error {
-	// First set all chains to accept in case something funky happens
-	cleanRules := getCleanupRules()
-	err := LoadIPv6Rules(cleanRules, false, persist)
+// clearTables resets every loaded table that is not skipped and returns a
+// report of what was cleared along with the rules that were loaded
+func clearTables(tools toolset, skip map[string]bool) ([]ClearedTable, *Rules, errorList) {
+	var errs errorList
+
+	live, err := getLiveRules(tools)
 	if err != nil {
-		return err
+		// we can still reset the tables the kernel knows about
+		errs = append(errs, err)
+		live = new(Rules)
 	}
 
-	// flush the nat & mangle tables
-	sh.Command(ip6tables, "-t", "nat", "-F").Run()
-	sh.Command(ip6tables, "-t", "mangle", "-F").Run()
-	// flush all chains
-	sh.Command(ip6tables, "-F").Run()
-	// delete all non-default chains
-	sh.Command(ip6tables, "-X").Run()
+	tableNames, err := getLoadedTables(tools)
+	if err != nil || len(tableNames) == 0 {
+		// nftables based iptables does not list its tables in /proc
+		tableNames = []string{}
+		for _, table := range live.Tables {
+			tableNames = append(tableNames, table.Name)
+		}
+	}
+	if len(tableNames) == 0 {
+		tableNames = []string{"filter"}
+	}
 
-	return nil
+	cleared := []ClearedTable{}
+	cleanRules := new(Rules)
+	for _, name := range tableNames {
+		if skip[name] {
+			continue
+		}
+		liveTable := live.Table(name)
+		if liveTable == nil {
+			liveTable = &Table{Name: name}
+		}
+		cleanTable := getCleanTable(liveTable)
+
+		// restoring a table without --noflush replaces its contents entirely
+		cleanBytes := (&Rules{Tables: []*Table{cleanTable}}).Bytes()
+		if err := restoreRules(tools, cleanBytes); err != nil {
+			errs = append(errs, errors.Wrapf(err, "clear %s table", name))
+			continue
+		}
+		cleanRules.Tables = append(cleanRules.Tables, cleanTable)
+
+		report := ClearedTable{Name: name, Rules: len(liveTable.Rules), Chains: []string{}}
+		for _, chain := range liveTable.Chains {
+			if cleanTable.Chain(chain.Name) == nil {
+				report.Chains = append(report.Chains, chain.Name)
+			}
+		}
+		cleared = append(cleared, report)
+	}
+
+	return cleared, cleanRules, errs
 }
 
-func GetIPv4Summary() string {
-	out, err := sh.Command(ip4tables, "-L", "-v", "-n").Output()
-	if err != nil {
-		return ""
+// getCleanTable returns the table with only its built-in chains, all set to accept
+func getCleanTable(liveTable *Table) *Table {
+	cleanTable := &Table{Name: liveTable.Name}
+	builtins, known := builtinChains[liveTable.Name]
+	if !known {
+		// fall back on the live policies to tell which chains are built-in
+		builtins = []string{}
+		for _, chain := range liveTable.Chains {
+			if chain.Policy != "-" {
+				builtins = append(builtins, chain.Name)
+			}
+		}
+	}
+	for _, name := range builtins {
+		cleanTable.Chains = append(cleanTable.Chains,
+			&Chain{Name: name, Policy: "ACCEPT", Declared: true})
 	}
-	return string(out)
+	return cleanTable
 }
 
-func GetIPv6Summary() string {
-	out, err := sh.Command(ip6tables, "-L", "-v", "-n").Output()
+// getLoadedTables returns the names of the tables the kernel has loaded
+func getLoadedTables(tools toolset) ([]string, error) {
+	data, err := ioutil.ReadFile(tools.tablesNames)
 	if err != nil {
-		return ""
+		return nil, err
+	}
+
+	tableNames := []string{}
+	for _, name := range strings.Fields(string(data)) {
+		tableNames = append(tableNames, name)
 	}
-	return string(out)
+	return tableNames, nil
 }
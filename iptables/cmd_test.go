@@ -0,0 +1,31 @@
+package iptables
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCleanTable(t *testing.T) {
+	live, err := ParseRules([]byte(`*raw
+:PREROUTING DROP [0:0]
+:OUTPUT ACCEPT [0:0]
+:NOTRACK-IN - [0:0]
+-A PREROUTING -j NOTRACK-IN
+COMMIT
+*broute
+:BROUTING DROP [0:0]
+:CUSTOM - [0:0]
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	clean := getCleanTable(live.Table("raw"))
+	expected := "*raw\n:PREROUTING ACCEPT [0:0]\n:OUTPUT ACCEPT [0:0]\nCOMMIT\n"
+	assert.Equal(t, expected, string((&Rules{Tables: []*Table{clean}}).Bytes()))
+
+	// tables we do not know about use the live policies to find built-in chains
+	clean = getCleanTable(live.Table("broute"))
+	expected = "*broute\n:BROUTING ACCEPT [0:0]\nCOMMIT\n"
+	assert.Equal(t, expected, string((&Rules{Tables: []*Table{clean}}).Bytes()))
+}
@@ -0,0 +1,111 @@
+package iptables
+
+// RuleSpecs maps the rules as they were written to the rules as iptables-save
+// lists them, since iptables adds matches like -m tcp and masks to addresses.
+// The keys are made with specKey.
+type RuleSpecs map[string]string
+
+func specKey(table string, chain string, spec string) string {
+	return table + " " + chain + " " + spec
+}
+
+// LearnSpecs pairs the written rules with the live rules right after they were
+// applied and returns the rules that iptables rewrote. Chains are paired from
+// the end, since the managed mode keeps foreign jumps at the top. Chains with
+// inserted or deleted rules, or that no longer line up, are skipped.
+func LearnSpecs(rules *Rules, live *Rules) RuleSpecs {
+	specs := make(RuleSpecs)
+	for _, table := range rules.Tables {
+		liveTable := live.Table(table.Name)
+		if liveTable == nil {
+			continue
+		}
+		for _, chain := range table.Chains {
+			if !onlyAppends(table, chain.Name) {
+				continue
+			}
+			written := table.ChainRules(chain.Name)
+			liveRules := liveTable.ChainRules(chain.Name)
+			if len(liveRules) < len(written) {
+				continue
+			}
+			liveRules = liveRules[len(liveRules)-len(written):]
+			if !sameTargets(written, liveRules) {
+				continue
+			}
+			for i, rule := range written {
+				if rule.Spec != liveRules[i].Spec {
+					specs[specKey(table.Name, chain.Name, rule.Spec)] = liveRules[i].Spec
+				}
+			}
+		}
+	}
+	return specs
+}
+
+// CarryCounters gives every appended rule without counters the counters of
+// the live rule it matches, so rules that did not change keep counting when
+// they are applied again. Built-in chains that keep their policy keep their
+// counters too.
+func CarryCounters(rules *Rules, live *Rules, specs RuleSpecs) {
+	for _, table := range rules.Tables {
+		liveTable := live.Table(table.Name)
+		if liveTable == nil {
+			continue
+		}
+		for _, chain := range table.Chains {
+			liveChain := liveTable.Chain(chain.Name)
+			if liveChain == nil {
+				continue
+			}
+			if chain.Declared && chain.Policy != "-" && chain.Policy == liveChain.Policy {
+				chain.Counters = liveChain.Counters
+			}
+
+			// identical rules take the counters of the live rules in order
+			counters := make(map[string][]*Counters)
+			for _, rule := range liveTable.ChainRules(chain.Name) {
+				if rule.Counters != nil {
+					counters[rule.Spec] = append(counters[rule.Spec], rule.Counters)
+				}
+			}
+			for _, rule := range table.ChainRules(chain.Name) {
+				if rule.Counters != nil {
+					continue
+				}
+				spec, ok := specs[specKey(table.Name, chain.Name, rule.Spec)]
+				if !ok {
+					spec = rule.Spec
+				}
+				if matches := counters[spec]; len(matches) > 0 {
+					carried := *matches[0]
+					rule.Counters = &carried
+					counters[spec] = matches[1:]
+				}
+			}
+		}
+	}
+}
+
+func onlyAppends(table *Table, chain string) bool {
+	for _, rule := range table.Rules {
+		if rule.Chain != chain {
+			continue
+		}
+		switch rule.Command {
+		case "-A", "-N", "-P":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func sameTargets(written []*Rule, live []*Rule) bool {
+	for i := range written {
+		if written[i].Target() != live[i].Target() {
+			return false
+		}
+	}
+	return true
+}
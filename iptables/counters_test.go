@@ -0,0 +1,87 @@
+package iptables
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLearnSpecs(t *testing.T) {
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:TEMPLR-IN - [0:0]
+:TEMPLR-OUT - [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp --dport 22 -j ACCEPT
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -s 192.0.2.1 -j ACCEPT
+-I TEMPLR-OUT -d 192.0.2.2 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	live, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:TEMPLR-IN - [0:0]
+:TEMPLR-OUT - [0:0]
+[3:4] -A INPUT -p tcp -m tcp --dport 22 -j f2b-sshd
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -s 192.0.2.1/32 -j DROP
+-A TEMPLR-OUT -d 192.0.2.2/32 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	specs := LearnSpecs(rules, live)
+	assert.Equal(t, RuleSpecs{
+		"filter INPUT -p tcp --dport 22 -j ACCEPT": "-p tcp -m tcp --dport 22 -j ACCEPT",
+	}, specs, "specs do not match")
+}
+
+func TestCarryCounters(t *testing.T) {
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp --dport 22 -j ACCEPT
+-A INPUT -p tcp --dport 443 -j ACCEPT
+-A INPUT -s 192.0.2.1 -j ACCEPT
+-A INPUT -s 192.0.2.1 -j ACCEPT
+[9:9] -A INPUT -s 192.0.2.3 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	live, err := ParseRules([]byte(`*filter
+:INPUT DROP [10:2000]
+:FORWARD ACCEPT [5:500]
+[1:100] -A INPUT -s 192.0.2.1/32 -j ACCEPT
+[2:200] -A INPUT -i lo -j ACCEPT
+[3:300] -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+[4:400] -A INPUT -p tcp -m tcp --dport 80 -j ACCEPT
+[5:500] -A INPUT -s 192.0.2.3/32 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	specs := RuleSpecs{
+		"filter INPUT -p tcp --dport 22 -j ACCEPT": "-p tcp -m tcp --dport 22 -j ACCEPT",
+		"filter INPUT -s 192.0.2.1 -j ACCEPT":      "-s 192.0.2.1/32 -j ACCEPT",
+	}
+	CarryCounters(rules, live, specs)
+
+	expected := `*filter
+:INPUT DROP [10:2000]
+:FORWARD DROP [0:0]
+[2:200] -A INPUT -i lo -j ACCEPT
+[3:300] -A INPUT -p tcp --dport 22 -j ACCEPT
+-A INPUT -p tcp --dport 443 -j ACCEPT
+[1:100] -A INPUT -s 192.0.2.1 -j ACCEPT
+-A INPUT -s 192.0.2.1 -j ACCEPT
+[9:9] -A INPUT -s 192.0.2.3 -j ACCEPT
+COMMIT
+`
+	assert.Equal(t, expected, string(rules.Bytes()), "rules do not match")
+}
@@ -0,0 +1,194 @@
+package iptables
+
+import (
+	"fmt"
+)
+
+// the kinds of change DiffRules reports
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// RuleChange is a rule that differs between the expected and live rules.
+// Position counts from 1 in the live chain, or in the expected chain for
+// removed rules.
+type RuleChange struct {
+	Kind     string `json:"kind" yaml:"kind"`
+	Position int    `json:"position" yaml:"position"`
+	Expected string `json:"expected,omitempty" yaml:"expected,omitempty"`
+	Live     string `json:"live,omitempty" yaml:"live,omitempty"`
+}
+
+func (c RuleChange) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %d: %s", c.Position, c.Live)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %d: %s", c.Position, c.Expected)
+	}
+	return fmt.Sprintf("~ %d: %s => %s", c.Position, c.Expected, c.Live)
+}
+
+// ChainDiff lists how a chain differs between the expected and live rules.
+// Kind is set when the whole chain was added or removed.
+type ChainDiff struct {
+	Table          string       `json:"table" yaml:"table"`
+	Chain          string       `json:"chain" yaml:"chain"`
+	Kind           string       `json:"kind,omitempty" yaml:"kind,omitempty"`
+	ExpectedPolicy string       `json:"expected_policy,omitempty" yaml:"expected_policy,omitempty"`
+	LivePolicy     string       `json:"live_policy,omitempty" yaml:"live_policy,omitempty"`
+	Changes        []RuleChange `json:"changes" yaml:"changes"`
+}
+
+// Lines describes the differences, one per line
+func (d ChainDiff) Lines() []string {
+	lines := []string{}
+	switch {
+	case d.Kind == ChangeAdded:
+		lines = append(lines, fmt.Sprintf("%s %s: chain added", d.Table, d.Chain))
+	case d.Kind == ChangeRemoved:
+		lines = append(lines, fmt.Sprintf("%s %s: chain removed", d.Table, d.Chain))
+	case d.ExpectedPolicy != d.LivePolicy:
+		lines = append(lines, fmt.Sprintf("%s %s: policy %s => %s", d.Table, d.Chain,
+			d.ExpectedPolicy, d.LivePolicy))
+	}
+	for _, change := range d.Changes {
+		lines = append(lines, fmt.Sprintf("%s %s: %s", d.Table, d.Chain, change))
+	}
+	return lines
+}
+
+// DiffRules compares the rules of every chain, counters are ignored. Only
+// chains that differ are returned.
+func DiffRules(expected *Rules, live *Rules) []ChainDiff {
+	diffs := []ChainDiff{}
+	for _, name := range tableNames(expected, live) {
+		expectedTable := expected.Table(name)
+		if expectedTable == nil {
+			expectedTable = &Table{Name: name}
+		}
+		liveTable := live.Table(name)
+		if liveTable == nil {
+			liveTable = &Table{Name: name}
+		}
+
+		for _, chain := range chainNames(expectedTable, liveTable) {
+			diff := ChainDiff{Table: name, Chain: chain}
+			expectedChain := expectedTable.Chain(chain)
+			liveChain := liveTable.Chain(chain)
+			switch {
+			case expectedChain == nil:
+				diff.Kind = ChangeAdded
+				diff.LivePolicy = liveChain.Policy
+			case liveChain == nil:
+				diff.Kind = ChangeRemoved
+				diff.ExpectedPolicy = expectedChain.Policy
+			default:
+				diff.ExpectedPolicy = expectedChain.Policy
+				diff.LivePolicy = liveChain.Policy
+			}
+
+			diff.Changes = diffChainRules(ruleSpecs(expectedTable.ChainRules(chain)),
+				ruleSpecs(liveTable.ChainRules(chain)))
+			if len(diff.Kind) > 0 || diff.ExpectedPolicy != diff.LivePolicy || len(diff.Changes) > 0 {
+				diffs = append(diffs, diff)
+			}
+		}
+	}
+	return diffs
+}
+
+// diffChainRules finds the smallest set of added and removed rules, a rule
+// removed where another was added is reported as modified
+func diffChainRules(expected []string, live []string) []RuleChange {
+	// lcs[i][j] is the longest common run of expected[i:] and live[j:]
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(live)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(live) - 1; j >= 0; j-- {
+			if expected[i] == live[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	changes := []RuleChange{}
+	removed := []RuleChange{}
+	added := []RuleChange{}
+	flush := func() {
+		pairs := len(removed)
+		if len(added) < pairs {
+			pairs = len(added)
+		}
+		for k := 0; k < pairs; k++ {
+			changes = append(changes, RuleChange{ChangeModified, added[k].Position,
+				removed[k].Expected, added[k].Live})
+		}
+		changes = append(changes, removed[pairs:]...)
+		changes = append(changes, added[pairs:]...)
+		removed = removed[:0]
+		added = added[:0]
+	}
+
+	i, j := 0, 0
+	for i < len(expected) || j < len(live) {
+		switch {
+		case i < len(expected) && j < len(live) && expected[i] == live[j]:
+			flush()
+			i++
+			j++
+		case j >= len(live) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, RuleChange{Kind: ChangeRemoved, Position: i + 1, Expected: expected[i]})
+			i++
+		default:
+			added = append(added, RuleChange{Kind: ChangeAdded, Position: j + 1, Live: live[j]})
+			j++
+		}
+	}
+	flush()
+	return changes
+}
+
+func ruleSpecs(rules []*Rule) []string {
+	specs := []string{}
+	for _, rule := range rules {
+		specs = append(specs, rule.Spec)
+	}
+	return specs
+}
+
+func tableNames(expected *Rules, live *Rules) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, rules := range []*Rules{expected, live} {
+		for _, table := range rules.Tables {
+			if !seen[table.Name] {
+				seen[table.Name] = true
+				names = append(names, table.Name)
+			}
+		}
+	}
+	return names
+}
+
+func chainNames(expected *Table, live *Table) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, table := range []*Table{expected, live} {
+		for _, chain := range table.Chains {
+			if !seen[chain.Name] {
+				seen[chain.Name] = true
+				names = append(names, chain.Name)
+			}
+		}
+	}
+	return names
+}
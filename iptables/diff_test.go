@@ -0,0 +1,54 @@
+package iptables
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffRules(t *testing.T) {
+	expected, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+:TEMPLR-IN - [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp --dport 22 -j ACCEPT
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -s 192.0.2.1 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	live, err := ParseRules([]byte(`*filter
+:INPUT DROP [10:2000]
+:FORWARD ACCEPT [0:0]
+:MANUAL - [0:0]
+[1:1] -A INPUT -s 198.51.100.7 -j ACCEPT
+[1:1] -A INPUT -i lo -j ACCEPT
+[1:1] -A INPUT -p tcp --dport 2222 -j ACCEPT
+[1:1] -A INPUT -j TEMPLR-IN
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	diffs := DiffRules(expected, live)
+	assert.Equal(t, []ChainDiff{
+		{Table: "filter", Chain: "INPUT", ExpectedPolicy: "DROP", LivePolicy: "DROP", Changes: []RuleChange{
+			{Kind: ChangeAdded, Position: 1, Live: "-s 198.51.100.7 -j ACCEPT"},
+			{Kind: ChangeModified, Position: 3, Expected: "-p tcp --dport 22 -j ACCEPT", Live: "-p tcp --dport 2222 -j ACCEPT"},
+		}},
+		{Table: "filter", Chain: "FORWARD", ExpectedPolicy: "DROP", LivePolicy: "ACCEPT", Changes: []RuleChange{}},
+		{Table: "filter", Chain: "TEMPLR-IN", Kind: ChangeRemoved, ExpectedPolicy: "-", Changes: []RuleChange{
+			{Kind: ChangeRemoved, Position: 1, Expected: "-s 192.0.2.1 -j ACCEPT"},
+		}},
+		{Table: "filter", Chain: "MANUAL", Kind: ChangeAdded, LivePolicy: "-", Changes: []RuleChange{}},
+	}, diffs, "diffs do not match")
+
+	assert.Equal(t, []string{
+		"filter INPUT: + 1: -s 198.51.100.7 -j ACCEPT",
+		"filter INPUT: ~ 3: -p tcp --dport 22 -j ACCEPT => -p tcp --dport 2222 -j ACCEPT",
+	}, diffs[0].Lines(), "lines do not match")
+	assert.Equal(t, []string{"filter FORWARD: policy DROP => ACCEPT"}, diffs[1].Lines(), "lines do not match")
+
+	assert.Empty(t, DiffRules(expected, expected), "unexpected drift")
+}
@@ -10,10 +10,15 @@ var ip4tables string
 var ip6tables string
 var ip4tablesRestore string
 var ip6tablesRestore string
+var ip4tablesSave string
+var ip6tablesSave string
 
 const ip4RulesPersistPath = "/etc/iptables/rules.v4"
 const ip6RulesPersistPath = "/etc/iptables/rules.v6"
 
+const ip4TablesNamesPath = "/proc/net/ip_tables_names"
+const ip6TablesNamesPath = "/proc/net/ip6_tables_names"
+
 func SetIP4TablesPath(path string) {
 	ip4tables = path
 }
@@ -30,6 +35,14 @@ func SetIP6TablesRestorePath(path string) {
 	ip6tablesRestore = path
 }
 
+func SetIP4TablesSavePath(path string) {
+	ip4tablesSave = path
+}
+
+func SetIP6TablesSavePath(path string) {
+	ip6tablesSave = path
+}
+
 func Find() error {
 	if err := FindIPv4(); err != nil {
 		return err
@@ -48,6 +61,9 @@ func FindIPv4() error {
 	if ip4tablesRestore, err = findUsableExe("iptables-restore"); err != nil {
 		return err
 	}
+	if ip4tablesSave, err = findUsableExe("iptables-save"); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -59,6 +75,9 @@ func FindIPv6() error {
 	if ip6tablesRestore, err = findUsableExe("ip6tables-restore"); err != nil {
 		return err
 	}
+	if ip6tablesSave, err = findUsableExe("ip6tables-save"); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,224 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ManagedChains describes the chains templr owns when it shares the firewall
+// with other tools such as docker, kubernetes or fail2ban. Owned chains are
+// the ones the rules declare or append to, any chain starting with Prefix and
+// any chain owned by a previous apply. Every other chain is left untouched.
+type ManagedChains struct {
+	Prefix string
+	Owned  map[string][]string
+}
+
+func (m ManagedChains) owns(table string, chain string) bool {
+	if len(m.Prefix) > 0 && strings.HasPrefix(chain, m.Prefix) {
+		return true
+	}
+	for _, name := range m.Owned[table] {
+		if name == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyManagedIPv4Rules replaces the IPv4 chains owned by templr with the given
+// rules and returns the chains now owned, by table. The whole live ruleset is
+// what gets persisted.
+func ApplyManagedIPv4Rules(rules []byte, managed ManagedChains, restoreCounters bool, persist bool) (map[string][]string, error) {
+	return applyManagedRules(ipv4Tools(), rules, managed, restoreCounters, persist)
+}
+
+// ApplyManagedIPv6Rules replaces the IPv6 chains owned by templr with the given
+// rules and returns the chains now owned, by table. The whole live ruleset is
+// what gets persisted.
+func ApplyManagedIPv6Rules(rules []byte, managed ManagedChains, restoreCounters bool, persist bool) (map[string][]string, error) {
+	return applyManagedRules(ipv6Tools(), rules, managed, restoreCounters, persist)
+}
+
+// UnloadManagedIPv4Rules releases the IPv4 chains owned by templr, leaving
+// every other chain in place. The rules that are left are what gets persisted.
+func UnloadManagedIPv4Rules(managed ManagedChains, persist bool) error {
+	return unloadManagedRules(ipv4Tools(), managed, persist)
+}
+
+// UnloadManagedIPv6Rules releases the IPv6 chains owned by templr, leaving
+// every other chain in place. The rules that are left are what gets persisted.
+func UnloadManagedIPv6Rules(managed ManagedChains, persist bool) error {
+	return unloadManagedRules(ipv6Tools(), managed, persist)
+}
+
+func unloadManagedRules(tools toolset, managed ManagedChains, persist bool) error {
+	_, err := applyManagedRules(tools, []byte{}, managed, false, persist)
+	return err
+}
+
+func applyManagedRules(tools toolset, rules []byte, managed ManagedChains, restoreCounters bool, persist bool) (map[string][]string, error) {
+	parsed, err := ParseRules(rules, tools.family)
+	if err != nil {
+		return nil, err
+	}
+	live, err := getLiveRules(tools)
+	if err != nil {
+		return nil, err
+	}
+
+	input, owned := buildManagedRules(live, parsed, managed, restoreCounters)
+
+	args := []interface{}{"--noflush"}
+	if restoreCounters {
+		args = append(args, "-c")
+	}
+	if err = restoreRules(tools, input, args...); err != nil {
+		return nil, err
+	}
+
+	if persist {
+		// only our rules, or accepting all on unload, would wipe the chains
+		// of the other tools at boot
+		if live, err = getLiveRules(tools); err != nil {
+			return nil, err
+		}
+		if err = persistRules(tools, live.Normalized().Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return owned, nil
+}
+
+// buildManagedRules generates the iptables-restore --noflush input that makes
+// the owned chains in live match rules. Jumps from owned chains to chains
+// owned by someone else are kept at the top of the chain, unless the rules
+// jump there themselves. Stale chains that a foreign chain still jumps to
+// are emptied and stay owned until the jump is gone.
+func buildManagedRules(live *Rules, rules *Rules, managed ManagedChains, withCounters bool) ([]byte, map[string][]string) {
+	owned := make(map[string][]string)
+	var buf bytes.Buffer
+
+	tableNames := []string{}
+	for _, table := range rules.Tables {
+		tableNames = append(tableNames, table.Name)
+	}
+	for _, table := range live.Tables {
+		if rules.Table(table.Name) != nil {
+			continue
+		}
+		for _, chain := range table.Chains {
+			if managed.owns(table.Name, chain.Name) {
+				tableNames = append(tableNames, table.Name)
+				break
+			}
+		}
+	}
+
+	for _, name := range tableNames {
+		newTable := rules.Table(name)
+		if newTable == nil {
+			newTable = &Table{Name: name}
+		}
+		liveTable := live.Table(name)
+		if liveTable == nil {
+			liveTable = &Table{Name: name}
+		}
+
+		isOwned := func(chain string) bool {
+			return newTable.Chain(chain) != nil || managed.owns(name, chain)
+		}
+
+		stale := []*Chain{}
+		isStale := make(map[string]bool)
+		for _, chain := range liveTable.Chains {
+			if newTable.Chain(chain.Name) == nil && managed.owns(name, chain.Name) {
+				stale = append(stale, chain)
+				isStale[chain.Name] = true
+			}
+		}
+
+		// chains the rules jump to, so the live jumps are not added twice
+		jumps := make(map[string]bool)
+		for _, rule := range newTable.Rules {
+			jumps[rule.Chain+" "+rule.Target()] = true
+		}
+		// stale chains can only be deleted once nothing jumps to them
+		referenced := make(map[string]bool)
+		for _, rule := range liveTable.Rules {
+			if !isOwned(rule.Chain) && !isStale[rule.Chain] {
+				referenced[rule.Target()] = true
+			}
+		}
+
+		fmt.Fprintf(&buf, "*%s\n", name)
+		for _, chain := range newTable.Chains {
+			owned[name] = append(owned[name], chain.Name)
+			if chain.Declared {
+				policy := chain.Policy
+				if !IsBuiltinChain(name, chain.Name) {
+					policy = "-"
+				}
+				counters := Counters{}
+				if withCounters {
+					counters = chain.Counters
+				}
+				fmt.Fprintf(&buf, ":%s %s %s\n", chain.Name, policy, counters)
+			}
+		}
+		for _, chain := range stale {
+			if IsBuiltinChain(name, chain.Name) {
+				// give up ownership of a built-in chain by opening it back up
+				fmt.Fprintf(&buf, ":%s ACCEPT [0:0]\n", chain.Name)
+			}
+		}
+
+		// empty every owned chain, then put back jumps to foreign chains
+		kept := []*Chain{}
+		for _, chain := range newTable.Chains {
+			if liveTable.Chain(chain.Name) == nil && !chain.Declared {
+				continue
+			}
+			fmt.Fprintf(&buf, "-F %s\n", chain.Name)
+			kept = append(kept, chain)
+		}
+		for _, chain := range stale {
+			fmt.Fprintf(&buf, "-F %s\n", chain.Name)
+			if IsBuiltinChain(name, chain.Name) {
+				kept = append(kept, chain)
+			}
+		}
+		for _, chain := range kept {
+			for _, rule := range liveTable.ChainRules(chain.Name) {
+				target := rule.Target()
+				if liveTable.Chain(target) == nil || isOwned(target) || jumps[chain.Name+" "+target] {
+					continue
+				}
+				jump := *rule
+				if !withCounters {
+					jump.Counters = nil
+				}
+				fmt.Fprintln(&buf, jump.String())
+			}
+		}
+
+		for _, rule := range newTable.Rules {
+			fmt.Fprintln(&buf, rule.String())
+		}
+
+		for _, chain := range stale {
+			if IsBuiltinChain(name, chain.Name) {
+				continue
+			}
+			if referenced[chain.Name] {
+				owned[name] = append(owned[name], chain.Name)
+				continue
+			}
+			fmt.Fprintf(&buf, "-X %s\n", chain.Name)
+		}
+		fmt.Fprintln(&buf, "COMMIT")
+	}
+
+	return buf.Bytes(), owned
+}
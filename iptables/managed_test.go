@@ -0,0 +1,242 @@
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildManagedRules(t *testing.T) {
+	live, err := ParseRules([]byte(`*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:DOCKER-USER - [0:0]
+:f2b-sshd - [0:0]
+:TEMPLR-OLD - [0:0]
+[7:8] -A INPUT -p tcp --dport 22 -j f2b-sshd
+-A INPUT -s 10.0.0.1 -j ACCEPT
+-A FORWARD -j DOCKER-USER
+-A f2b-sshd -j RETURN
+COMMIT
+*nat
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+-A POSTROUTING -j DOCKER
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:TEMPLR-IN - [0:0]
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -p tcp --dport 80 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	managed := ManagedChains{Prefix: "TEMPLR-"}
+	input, owned := buildManagedRules(live, rules, managed, false)
+
+	expected := `*filter
+:INPUT DROP [0:0]
+:TEMPLR-IN - [0:0]
+-F INPUT
+-F TEMPLR-IN
+-F TEMPLR-OLD
+-A INPUT -p tcp --dport 22 -j f2b-sshd
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -p tcp --dport 80 -j ACCEPT
+-X TEMPLR-OLD
+COMMIT
+`
+	assert.Equal(t, expected, string(input), "rules do not match")
+	assert.Equal(t, map[string][]string{"filter": {"INPUT", "TEMPLR-IN"}}, owned, "owned chains do not match")
+}
+
+func TestBuildManagedRulesRelease(t *testing.T) {
+	live, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+:FORWARD ACCEPT [0:0]
+:LOGDROP - [0:0]
+:f2b-sshd - [0:0]
+[7:8] -A INPUT -p tcp --dport 22 -j f2b-sshd
+-A INPUT -j LOGDROP
+-A LOGDROP -j DROP
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	managed := ManagedChains{Owned: map[string][]string{"filter": {"INPUT", "LOGDROP"}}}
+	input, owned := buildManagedRules(live, &Rules{}, managed, true)
+
+	expected := `*filter
+:INPUT ACCEPT [0:0]
+-F INPUT
+-F LOGDROP
+[7:8] -A INPUT -p tcp --dport 22 -j f2b-sshd
+-X LOGDROP
+COMMIT
+`
+	assert.Equal(t, expected, string(input), "rules do not match")
+	assert.Empty(t, owned, "unexpected owned chains")
+}
+
+func TestBuildManagedRulesCounters(t *testing.T) {
+	live, err := ParseRules([]byte(`*filter
+:INPUT DROP [10:2000]
+:f2b-sshd - [0:0]
+[7:8] -A INPUT -p tcp --dport 22 -j f2b-sshd
+[5:6] -A INPUT -i lo -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [10:2000]
+[5:6] -A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp --dport 80 -j ACCEPT
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	input, _ := buildManagedRules(live, rules, ManagedChains{}, true)
+
+	expected := `*filter
+:INPUT DROP [10:2000]
+-F INPUT
+[7:8] -A INPUT -p tcp --dport 22 -j f2b-sshd
+[5:6] -A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp --dport 80 -j ACCEPT
+COMMIT
+`
+	assert.Equal(t, expected, string(input), "rules do not match")
+}
+
+func TestBuildManagedRulesDeclaredJumps(t *testing.T) {
+	live, err := ParseRules([]byte(`*filter
+:INPUT ACCEPT [0:0]
+:f2b-sshd - [0:0]
+-A INPUT -p tcp -m tcp --dport 22 -j f2b-sshd
+-A f2b-sshd -j RETURN
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+-A INPUT -p tcp --dport 22 -j f2b-sshd
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	input, _ := buildManagedRules(live, rules, ManagedChains{}, false)
+
+	expected := `*filter
+:INPUT DROP [0:0]
+-F INPUT
+-A INPUT -p tcp --dport 22 -j f2b-sshd
+COMMIT
+`
+	assert.Equal(t, expected, string(input), "the jump should not be added twice")
+}
+
+func TestBuildManagedRulesReferencedChain(t *testing.T) {
+	live, err := ParseRules([]byte(`*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:DOCKER-USER - [0:0]
+:TEMPLR-OLD - [0:0]
+:TEMPLR-GONE - [0:0]
+-A INPUT -j TEMPLR-GONE
+-A FORWARD -j DOCKER-USER
+-A DOCKER-USER -j TEMPLR-OLD
+-A TEMPLR-OLD -j DROP
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	rules, err := ParseRules([]byte(`*filter
+:INPUT DROP [0:0]
+COMMIT
+`), AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	managed := ManagedChains{Prefix: "TEMPLR-"}
+	input, owned := buildManagedRules(live, rules, managed, false)
+
+	expected := `*filter
+:INPUT DROP [0:0]
+-F INPUT
+-F TEMPLR-OLD
+-F TEMPLR-GONE
+-X TEMPLR-GONE
+COMMIT
+`
+	assert.Equal(t, expected, string(input), "rules do not match")
+	assert.Equal(t, map[string][]string{"filter": {"INPUT", "TEMPLR-OLD"}}, owned,
+		"a chain docker still jumps to should stay owned")
+}
+
+func TestUnloadManagedRulesPersistsForeignChains(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	tools := writeManagedTestTools(t, dirPath)
+	err = unloadManagedRules(tools, ManagedChains{Prefix: "TEMPLR-"}, true)
+	assert.NoError(t, err, "unexpected error")
+
+	persisted, err := ioutil.ReadFile(tools.persistPath)
+	assert.NoError(t, err, "expected the rules to be persisted")
+	assert.Contains(t, string(persisted), "-A FORWARD -j DOCKER-USER", "foreign rules should be persisted")
+	assert.NotContains(t, string(persisted), "[3:4]", "counters should not be persisted")
+}
+
+func TestApplyManagedRulesPersistsForeignChains(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	tools := writeManagedTestTools(t, dirPath)
+	rules := []byte("*filter\n:INPUT DROP [0:0]\n-A INPUT -i lo -j ACCEPT\nCOMMIT\n")
+	_, err = applyManagedRules(tools, rules, ManagedChains{}, false, true)
+	assert.NoError(t, err, "unexpected error")
+
+	persisted, err := ioutil.ReadFile(tools.persistPath)
+	assert.NoError(t, err, "expected the rules to be persisted")
+	assert.Contains(t, string(persisted), ":DOCKER-USER - [0:0]", "foreign chains should be persisted")
+	assert.Contains(t, string(persisted), "-A FORWARD -j DOCKER-USER", "foreign rules should be persisted")
+}
+
+// writeManagedTestTools writes stand in iptables tools, the live rules have a
+// docker chain
+func writeManagedTestTools(t *testing.T, dirPath string) toolset {
+	tools := toolset{
+		family:      IPv4,
+		restore:     path.Join(dirPath, "iptables-restore"),
+		save:        path.Join(dirPath, "iptables-save"),
+		persistPath: path.Join(dirPath, "rules.v4"),
+	}
+	files := map[string]string{
+		tools.restore: "#!/bin/sh\n",
+		tools.save: `#!/bin/sh
+cat <<'X'
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:DOCKER-USER - [0:0]
+[3:4] -A FORWARD -j DOCKER-USER
+COMMIT
+X
+`,
+	}
+	for name, contents := range files {
+		err := ioutil.WriteFile(name, []byte(contents), 0755)
+		assert.NoError(t, err, "test file write error")
+	}
+	return tools
+}
@@ -0,0 +1,143 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ndpTypes are the ICMPv6 types of neighbour discovery: router solicitation
+// and advertisement, neighbour solicitation and advertisement
+var ndpTypes = []int{133, 134, 135, 136}
+
+// LockdownIPv4Rules saves the live IPv4 rules to savePath and replaces them
+// with rules that only allow loopback, established connections and the given
+// management networks. Every other loaded table is cleared.
+func LockdownIPv4Rules(savePath string, managementNets []string) error {
+	return lockdownRules(ipv4Tools(), savePath, managementNets)
+}
+
+// LockdownIPv6Rules saves the live IPv6 rules to savePath and replaces them
+// with rules that only allow loopback, established connections, neighbour
+// discovery and the given management networks. Every other loaded table is
+// cleared.
+func LockdownIPv6Rules(savePath string, managementNets []string) error {
+	return lockdownRules(ipv6Tools(), savePath, managementNets)
+}
+
+// ReleaseIPv4Rules restores the IPv4 rules saved by LockdownIPv4Rules
+func ReleaseIPv4Rules(savePath string) error {
+	return releaseRules(ipv4Tools(), savePath)
+}
+
+// ReleaseIPv6Rules restores the IPv6 rules saved by LockdownIPv6Rules
+func ReleaseIPv6Rules(savePath string) error {
+	return releaseRules(ipv6Tools(), savePath)
+}
+
+func lockdownRules(tools toolset, savePath string, managementNets []string) error {
+	rules, err := getLockdownRules(tools.family, managementNets)
+	if err != nil {
+		return err
+	}
+
+	// if we are already locked down, the saved rules are the ones to go back to
+	if _, err = os.Stat(savePath); os.IsNotExist(err) {
+		live, err := saveRules(tools)
+		if err != nil {
+			return err
+		}
+		if err = writeFile(savePath, live); err != nil {
+			return err
+		}
+	}
+
+	if err = restoreRules(tools, rules); err != nil {
+		return err
+	}
+
+	// forwards and rewrites in the other tables stay live otherwise
+	_, _, errs := clearTables(tools, map[string]bool{"filter": true})
+	return errs.errOrNil()
+}
+
+func releaseRules(tools toolset, savePath string) error {
+	saved, err := ioutil.ReadFile(savePath)
+	if os.IsNotExist(err) {
+		return errors.Errorf("no saved %s rules to release", tools.family)
+	} else if err != nil {
+		return errors.Wrapf(err, "read saved rules")
+	}
+
+	if err = restoreRules(tools, saved, "-c"); err != nil {
+		return err
+	}
+	return os.Remove(savePath)
+}
+
+// getLockdownRules returns the rules for the given family that only allow
+// loopback, established connections and the management networks
+func getLockdownRules(family Family, managementNets []string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "*filter")
+	fmt.Fprintln(&buf, ":INPUT DROP [0:0]")
+	fmt.Fprintln(&buf, ":FORWARD DROP [0:0]")
+	fmt.Fprintln(&buf, ":OUTPUT DROP [0:0]")
+	fmt.Fprintln(&buf, "-A INPUT -i lo -j ACCEPT")
+	fmt.Fprintln(&buf, "-A OUTPUT -o lo -j ACCEPT")
+	fmt.Fprintln(&buf, "-A INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT")
+	fmt.Fprintln(&buf, "-A OUTPUT -m state --state RELATED,ESTABLISHED -j ACCEPT")
+	if family == IPv6 {
+		// without neighbour discovery no IPv6 address on the link can be reached
+		for _, icmpType := range ndpTypes {
+			fmt.Fprintf(&buf, "-A INPUT -p ipv6-icmp -m icmp6 --icmpv6-type %d -j ACCEPT\n", icmpType)
+			fmt.Fprintf(&buf, "-A OUTPUT -p ipv6-icmp -m icmp6 --icmpv6-type %d -j ACCEPT\n", icmpType)
+		}
+	}
+
+	for _, network := range managementNets {
+		ipNet, err := parseNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if isIPv4 != (family == IPv4) {
+			continue
+		}
+		fmt.Fprintf(&buf, "-A INPUT -s %s -j ACCEPT\n", ipNet)
+		fmt.Fprintf(&buf, "-A OUTPUT -d %s -j ACCEPT\n", ipNet)
+	}
+
+	fmt.Fprintln(&buf, "COMMIT")
+	return buf.Bytes(), nil
+}
+
+// CheckManagementNets returns an error for the first management network that
+// is not a CIDR range or an address
+func CheckManagementNets(managementNets []string) error {
+	for _, network := range managementNets {
+		if _, err := parseNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNetwork parses a CIDR range or a single address without using DNS
+func parseNetwork(network string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(network); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(network)
+	if ip == nil {
+		return nil, errors.Errorf("invalid management network '%s'", network)
+	}
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
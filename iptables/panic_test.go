@@ -0,0 +1,120 @@
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLockdownRules(t *testing.T) {
+	rules, err := getLockdownRules(IPv4, []string{"10.1.0.0/16", "192.168.1.10", "2001:db8::/32"})
+	assert.NoError(t, err, "unexpected error")
+
+	parsed, err := ParseRules(rules, IPv4)
+	assert.NoError(t, err, "unexpected error")
+	table := parsed.Table("filter")
+	assert.Equal(t, "DROP", table.Chain("INPUT").Policy, "policy does not match")
+
+	specs := []string{}
+	for _, rule := range table.ChainRules("INPUT") {
+		specs = append(specs, rule.Spec)
+	}
+	assert.Contains(t, specs, "-s 10.1.0.0/16 -j ACCEPT")
+	assert.Contains(t, specs, "-s 192.168.1.10/32 -j ACCEPT")
+	assert.NotContains(t, specs, "-s 2001:db8::/32 -j ACCEPT")
+}
+
+func TestGetLockdownRulesInvalidNetwork(t *testing.T) {
+	_, err := getLockdownRules(IPv4, []string{"mgmt.example.com"})
+	assert.Error(t, err, "expected an error")
+}
+
+func TestCheckManagementNets(t *testing.T) {
+	assert.NoError(t, CheckManagementNets([]string{"10.1.0.0/16", "192.168.1.10", "2001:db8::/32"}))
+	assert.EqualError(t, CheckManagementNets([]string{"10.1.0.0/16", "bogus"}),
+		"invalid management network 'bogus'", "error does not match")
+}
+
+func TestGetLockdownRulesIPv6(t *testing.T) {
+	rules, err := getLockdownRules(IPv6, []string{"10.1.0.0/16", "2001:db8::/32"})
+	assert.NoError(t, err, "unexpected error")
+
+	parsed, err := ParseRules(rules, IPv6)
+	assert.NoError(t, err, "unexpected error")
+	table := parsed.Table("filter")
+	for _, chain := range []string{"INPUT", "OUTPUT"} {
+		specs := []string{}
+		for _, rule := range table.ChainRules(chain) {
+			specs = append(specs, rule.Spec)
+		}
+		for _, icmpType := range []string{"133", "134", "135", "136"} {
+			assert.Contains(t, specs, "-p ipv6-icmp -m icmp6 --icmpv6-type "+icmpType+" -j ACCEPT",
+				"expected neighbour discovery in %s", chain)
+		}
+	}
+	assert.NotContains(t, string(rules), "10.1.0.0/16", "IPv4 networks should be left out")
+	assert.Contains(t, string(rules), "-A INPUT -s 2001:db8::/32 -j ACCEPT")
+
+	rules, err = getLockdownRules(IPv4, nil)
+	assert.NoError(t, err, "unexpected error")
+	assert.NotContains(t, string(rules), "ipv6-icmp", "IPv4 rules should not allow ICMPv6")
+}
+
+func TestLockdownClearsOtherTables(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(dirPath) // clean up
+
+	restoredPath := path.Join(dirPath, "restored")
+	tools := toolset{
+		family:      IPv4,
+		restore:     path.Join(dirPath, "iptables-restore"),
+		save:        path.Join(dirPath, "iptables-save"),
+		tablesNames: path.Join(dirPath, "ip_tables_names"),
+	}
+	files := map[string]string{
+		tools.restore: "#!/bin/sh\nfor arg; do rules=$arg; done\ncat $rules >> " + restoredPath + "\n",
+		tools.save: `#!/bin/sh
+cat <<'X'
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+-A PREROUTING -p tcp --dport 8080 -j DNAT --to-destination 10.0.0.2:80
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+COMMIT
+X
+`,
+		tools.tablesNames: "nat\nfilter\n",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(name, []byte(contents), 0755)
+		assert.NoError(t, err, "test file write error")
+	}
+
+	savePath := path.Join(dirPath, "panic.ipv4.rules")
+	err = lockdownRules(tools, savePath, []string{"10.1.0.0/16"})
+	assert.NoError(t, err, "unexpected error")
+
+	saved, err := ioutil.ReadFile(savePath)
+	assert.NoError(t, err, "expected the live rules to be saved")
+	assert.Contains(t, string(saved), "DNAT", "saved rules do not match")
+
+	restored, err := ioutil.ReadFile(restoredPath)
+	assert.NoError(t, err, "expected rules to be restored")
+	parsed, err := ParseRules(restored, IPv4)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, "DROP", parsed.Table("filter").Chain("INPUT").Policy, "filter should be locked down")
+	nat := parsed.Table("nat")
+	if assert.NotNil(t, nat, "expected the nat table to be cleared") {
+		assert.Empty(t, nat.Rules, "nat rules should be cleared")
+	}
+}
@@ -0,0 +1,406 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Family is the ip protocol version a set of rules applies to
+type Family int
+
+const (
+	// AnyFamily keeps rules for every family when parsing
+	AnyFamily Family = 0
+	// IPv4 rules are handled by iptables
+	IPv4 Family = 4
+	// IPv6 rules are handled by ip6tables
+	IPv6 Family = 6
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	}
+	return "any"
+}
+
+// builtinChains lists the chains the kernel creates for each table
+var builtinChains = map[string][]string{
+	"filter":   {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":      {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"mangle":   {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"raw":      {"PREROUTING", "OUTPUT"},
+	"security": {"INPUT", "FORWARD", "OUTPUT"},
+}
+
+// IsBuiltinChain returns true if the chain is created by the kernel for the table
+func IsBuiltinChain(table string, chain string) bool {
+	for _, name := range builtinChains[table] {
+		if name == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// Counters are the packet and byte counters of a chain or rule
+type Counters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+func (c Counters) String() string {
+	return fmt.Sprintf("[%d:%d]", c.Packets, c.Bytes)
+}
+
+// Rule is a single command line in a table, usually an append (-A)
+type Rule struct {
+	Command  string
+	Chain    string
+	Spec     string
+	Counters *Counters
+}
+
+// Args returns the rule specification split into arguments
+func (r *Rule) Args() []string {
+	return splitArgs(r.Spec)
+}
+
+// Target returns the chain or target the rule jumps to, if any
+func (r *Rule) Target() string {
+	return argValue(r.Args(), "-j", "--jump", "-g", "--goto")
+}
+
+// Comment returns the comment of the rule, if it has one
+func (r *Rule) Comment() string {
+	return argValue(r.Args(), "--comment")
+}
+
+func (r *Rule) String() string {
+	line := r.Command
+	if len(r.Chain) > 0 {
+		line += " " + r.Chain
+	}
+	if len(r.Spec) > 0 {
+		line += " " + r.Spec
+	}
+	if r.Counters != nil {
+		line = r.Counters.String() + " " + line
+	}
+	return line
+}
+
+// Chain is a chain that was declared in, or used by the rules of, a table
+type Chain struct {
+	Name     string
+	Policy   string
+	Counters Counters
+	Declared bool
+}
+
+// Table holds the chains and rules for a single netfilter table
+type Table struct {
+	Name   string
+	Chains []*Chain
+	Rules  []*Rule
+}
+
+// Chain returns the named chain, or nil if the table does not have it
+func (t *Table) Chain(name string) *Chain {
+	for _, chain := range t.Chains {
+		if chain.Name == name {
+			return chain
+		}
+	}
+	return nil
+}
+
+// ChainRules returns the rules appended to the named chain, in order
+func (t *Table) ChainRules(name string) []*Rule {
+	rules := []*Rule{}
+	for _, rule := range t.Rules {
+		if rule.Chain == name && rule.Command == "-A" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (t *Table) addChain(name string) *Chain {
+	chain := t.Chain(name)
+	if chain == nil {
+		chain = &Chain{Name: name, Policy: "-"}
+		t.Chains = append(t.Chains, chain)
+	}
+	return chain
+}
+
+// Rules is a ruleset in the iptables-save/iptables-restore format
+type Rules struct {
+	Tables []*Table
+}
+
+// Table returns the named table, or nil if the ruleset does not have it
+func (r *Rules) Table(name string) *Table {
+	for _, table := range r.Tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// Bytes returns the ruleset in the iptables-restore format
+func (r *Rules) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, table := range r.Tables {
+		fmt.Fprintf(&buf, "*%s\n", table.Name)
+		for _, chain := range table.Chains {
+			if chain.Declared {
+				fmt.Fprintf(&buf, ":%s %s %s\n", chain.Name, chain.Policy, chain.Counters)
+			}
+		}
+		for _, rule := range table.Rules {
+			fmt.Fprintln(&buf, rule.String())
+		}
+		fmt.Fprintln(&buf, "COMMIT")
+	}
+	return buf.Bytes()
+}
+
+// Normalized returns a copy of the rules without any counters, so rules saved
+// at different times can be compared
+func (r *Rules) Normalized() *Rules {
+	normalized := new(Rules)
+	for _, table := range r.Tables {
+		newTable := &Table{Name: table.Name}
+		for _, chain := range table.Chains {
+			newTable.Chains = append(newTable.Chains, &Chain{
+				Name:     chain.Name,
+				Policy:   chain.Policy,
+				Declared: chain.Declared,
+			})
+		}
+		for _, rule := range table.Rules {
+			newTable.Rules = append(newTable.Rules, &Rule{
+				Command: rule.Command,
+				Chain:   rule.Chain,
+				Spec:    rule.Spec,
+			})
+		}
+		normalized.Tables = append(normalized.Tables, newTable)
+	}
+	return normalized
+}
+
+// Select returns the given chains of each table and their rules, tables
+// without any of the chains are left out
+func (r *Rules) Select(chains map[string][]string) *Rules {
+	selected := new(Rules)
+	for _, table := range r.Tables {
+		keep := make(map[string]bool)
+		for _, name := range chains[table.Name] {
+			keep[name] = true
+		}
+
+		newTable := &Table{Name: table.Name}
+		for _, chain := range table.Chains {
+			if keep[chain.Name] {
+				newTable.Chains = append(newTable.Chains, chain)
+			}
+		}
+		for _, rule := range table.Rules {
+			if keep[rule.Chain] {
+				newTable.Rules = append(newTable.Rules, rule)
+			}
+		}
+		if len(newTable.Chains) > 0 {
+			selected.Tables = append(selected.Tables, newTable)
+		}
+	}
+	return selected
+}
+
+// ParseRules parses a ruleset in the iptables-save format. Rules prefixed with
+// a family flag (-4 or -6) are dropped when they do not match the given family,
+// AnyFamily keeps them all.
+func ParseRules(data []byte, family Family) (*Rules, error) {
+	rules := new(Rules)
+	var table *Table
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		switch {
+		case line[0] == '*':
+			name := strings.TrimSpace(line[1:])
+			if table = rules.Table(name); table == nil {
+				table = &Table{Name: name}
+				rules.Tables = append(rules.Tables, table)
+			}
+			continue
+		case line == "COMMIT":
+			table = nil
+			continue
+		}
+
+		if table == nil {
+			return nil, errors.Errorf("line %d: rule outside of a table", lineNum)
+		}
+
+		if line[0] == ':' {
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, errors.Errorf("line %d: invalid chain declaration", lineNum)
+			}
+			chain := table.addChain(fields[0])
+			chain.Policy = fields[1]
+			chain.Declared = true
+			if len(fields) > 2 {
+				counters, err := parseCounters(fields[2])
+				if err != nil {
+					return nil, errors.Wrapf(err, "line %d", lineNum)
+				}
+				chain.Counters = *counters
+			}
+			continue
+		}
+
+		rule, keep, err := parseRule(line, family)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNum)
+		}
+		if !keep {
+			continue
+		}
+		if len(rule.Chain) > 0 && (rule.Command == "-A" || rule.Command == "-I") {
+			table.addChain(rule.Chain)
+		}
+		table.Rules = append(table.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "read rules")
+	}
+
+	return rules, nil
+}
+
+func parseRule(line string, family Family) (*Rule, bool, error) {
+	rule := new(Rule)
+	if line[0] == '[' {
+		end := strings.IndexByte(line, ']')
+		if end < 0 {
+			return nil, false, errors.New("invalid counters")
+		}
+		counters, err := parseCounters(line[:end+1])
+		if err != nil {
+			return nil, false, err
+		}
+		rule.Counters = counters
+		line = strings.TrimSpace(line[end+1:])
+	}
+
+	command, rest := nextField(line)
+	if command == "-4" || command == "-6" {
+		if family != AnyFamily && command != fmt.Sprintf("-%d", family) {
+			return nil, false, nil
+		}
+		command, rest = nextField(rest)
+	}
+	if len(command) == 0 || command[0] != '-' {
+		return nil, false, errors.Errorf("unknown command '%s'", command)
+	}
+	rule.Command = command
+	rule.Chain, rule.Spec = nextField(rest)
+
+	return rule, true, nil
+}
+
+func parseCounters(field string) (*Counters, error) {
+	if len(field) < 2 || field[0] != '[' || field[len(field)-1] != ']' {
+		return nil, errors.Errorf("invalid counters '%s'", field)
+	}
+	parts := strings.Split(field[1:len(field)-1], ":")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid counters '%s'", field)
+	}
+	packets, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid counters '%s'", field)
+	}
+	byteCount, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid counters '%s'", field)
+	}
+	return &Counters{packets, byteCount}, nil
+}
+
+func nextField(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	end := strings.IndexAny(line, " \t")
+	if end < 0 {
+		return line, ""
+	}
+	return line[:end], strings.TrimSpace(line[end:])
+}
+
+// splitArgs splits a rule specification into arguments the way the shell
+// would, honouring double quotes and backslash escapes used by iptables-save
+func splitArgs(spec string) []string {
+	args := []string{}
+	var arg bytes.Buffer
+	inArg := false
+	inQuote := false
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		switch {
+		case c == '\\' && i+1 < len(spec):
+			i++
+			arg.WriteByte(spec[i])
+			inArg = true
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// argValue returns the value following the first of the given options
+func argValue(args []string, options ...string) string {
+	for i := 0; i < len(args)-1; i++ {
+		for _, option := range options {
+			if args[i] == option {
+				return args[i+1]
+			}
+		}
+	}
+	return ""
+}
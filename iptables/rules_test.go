@@ -0,0 +1,125 @@
+package iptables
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	data := []byte(`# Generated by iptables-save
+*filter
+:INPUT DROP [10:2000]
+:FORWARD ACCEPT [0:0]
+:TEMPLR-IN - [0:0]
+[5:300] -A INPUT -i lo -j ACCEPT
+-A INPUT -m comment --comment "allow ssh" -p tcp --dport 22 -j TEMPLR-IN
+COMMIT
+`)
+
+	rules, err := ParseRules(data, AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+	assert.Len(t, rules.Tables, 1, "unexpected tables")
+
+	table := rules.Table("filter")
+	assert.NotNil(t, table, "missing table")
+	assert.Len(t, table.Chains, 3, "unexpected chains")
+	assert.Equal(t, "DROP", table.Chain("INPUT").Policy, "policy does not match")
+	assert.Equal(t, Counters{10, 2000}, table.Chain("INPUT").Counters, "counters do not match")
+	assert.Equal(t, "-", table.Chain("TEMPLR-IN").Policy, "policy does not match")
+
+	rulesIn := table.ChainRules("INPUT")
+	assert.Len(t, rulesIn, 2, "unexpected rules")
+	assert.Equal(t, &Counters{5, 300}, rulesIn[0].Counters, "counters do not match")
+	assert.Equal(t, "ACCEPT", rulesIn[0].Target(), "target does not match")
+	assert.Nil(t, rulesIn[1].Counters, "unexpected counters")
+	assert.Equal(t, "TEMPLR-IN", rulesIn[1].Target(), "target does not match")
+	assert.Equal(t, "allow ssh", rulesIn[1].Comment(), "comment does not match")
+	assert.Equal(t, "", rulesIn[0].Comment(), "unexpected comment")
+}
+
+func TestParseRulesFamily(t *testing.T) {
+	data := []byte(`*filter
+-4 -A INPUT -s 10.0.0.1 -j ACCEPT
+-6 -A INPUT -s fe80::1 -j ACCEPT
+-A INPUT -j DROP
+COMMIT
+`)
+
+	rules, err := ParseRules(data, IPv4)
+	assert.NoError(t, err, "unexpected error")
+	specs := []string{}
+	for _, rule := range rules.Table("filter").ChainRules("INPUT") {
+		specs = append(specs, rule.Spec)
+	}
+	assert.Equal(t, []string{"-s 10.0.0.1 -j ACCEPT", "-j DROP"}, specs, "rules do not match")
+
+	rules, err = ParseRules(data, AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+	assert.Len(t, rules.Table("filter").Rules, 3, "unexpected rules")
+}
+
+func TestParseRulesOutsideTable(t *testing.T) {
+	_, err := ParseRules([]byte(`-A INPUT -j DROP`), AnyFamily)
+	assert.Error(t, err, "expected an error")
+}
+
+func TestRulesBytes(t *testing.T) {
+	data := []byte(`*filter
+:INPUT ACCEPT [1:2]
+:TEMPLR-IN - [0:0]
+[3:4] -A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -j DROP
+COMMIT
+`)
+
+	rules, err := ParseRules(data, AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, string(data), string(rules.Bytes()), "rules do not match")
+}
+
+func TestNormalizeAndSelect(t *testing.T) {
+	data := []byte(`*filter
+:INPUT DROP [10:2000]
+:f2b-sshd - [0:0]
+:TEMPLR-IN - [0:0]
+[5:300] -A INPUT -j TEMPLR-IN
+[1:60] -A f2b-sshd -s 192.0.2.1 -j REJECT
+[5:300] -A TEMPLR-IN -i lo -j ACCEPT
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+COMMIT
+`)
+	rules, err := ParseRules(data, AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+
+	normalized := rules.Normalized()
+	assert.Equal(t, `*filter
+:INPUT DROP [0:0]
+:f2b-sshd - [0:0]
+:TEMPLR-IN - [0:0]
+-A INPUT -j TEMPLR-IN
+-A f2b-sshd -s 192.0.2.1 -j REJECT
+-A TEMPLR-IN -i lo -j ACCEPT
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+COMMIT
+`, string(normalized.Bytes()), "normalized rules do not match")
+	assert.Equal(t, &Counters{5, 300}, rules.Table("filter").Rules[0].Counters, "original counters changed")
+
+	selected := normalized.Select(map[string][]string{"filter": {"INPUT", "TEMPLR-IN"}})
+	assert.Equal(t, `*filter
+:INPUT DROP [0:0]
+:TEMPLR-IN - [0:0]
+-A INPUT -j TEMPLR-IN
+-A TEMPLR-IN -i lo -j ACCEPT
+COMMIT
+`, string(selected.Bytes()), "selected rules do not match")
+}
+
+func TestSplitArgs(t *testing.T) {
+	args := splitArgs(`-m comment --comment "allow \"web\" traffic" -j ACCEPT`)
+	assert.Equal(t, []string{"-m", "comment", "--comment", `allow "web" traffic`, "-j", "ACCEPT"}, args)
+}
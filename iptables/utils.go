@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -29,3 +30,21 @@ func getTempFile() (*os.File, error) {
 	}
 	return file, nil
 }
+
+// errorList collects the errors from steps that should not stop each other
+type errorList []error
+
+func (e errorList) Error() string {
+	msgs := []string{}
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e errorList) errOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,204 @@
+package report
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gesquive/templr/iptables"
+	"github.com/pkg/errors"
+)
+
+// SourceHits are the counters of every live rule generated from one line of
+// a template
+type SourceHits struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Rules   int    `json:"rules"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Source returns where in the templates the rules came from
+func (h SourceHits) Source() string {
+	if h.Line == 0 {
+		return h.File
+	}
+	return h.File + ":" + strconv.Itoa(h.Line)
+}
+
+// Snapshot holds the hits of each template line at a point in time
+type Snapshot struct {
+	Taken   time.Time    `json:"taken"`
+	Sources []SourceHits `json:"sources"`
+}
+
+// Hits are the hits of a template line since a snapshot, with the rate per
+// second. The rates are zero without a snapshot to compare with.
+type Hits struct {
+	SourceHits
+	PacketRate float64 `json:"packet_rate"`
+	ByteRate   float64 `json:"byte_rate"`
+}
+
+// TakeSnapshot adds up the counters of the rules by the template line in
+// their provenance comment, rules without one are left out
+func TakeSnapshot(rules []*iptables.Rules, format string) *Snapshot {
+	parse := provenanceParser(format)
+	sources := make(map[string]*SourceHits)
+	for _, ruleset := range rules {
+		if ruleset == nil {
+			continue
+		}
+		for _, table := range ruleset.Tables {
+			for _, rule := range table.Rules {
+				file, line, ok := parse(rule.Comment())
+				if !ok {
+					continue
+				}
+				key := SourceHits{File: file, Line: line}.Source()
+				source, found := sources[key]
+				if !found {
+					source = &SourceHits{File: file, Line: line}
+					sources[key] = source
+				}
+				source.Rules++
+				if rule.Counters != nil {
+					source.Packets += rule.Counters.Packets
+					source.Bytes += rule.Counters.Bytes
+				}
+			}
+		}
+	}
+
+	snapshot := &Snapshot{Taken: time.Now(), Sources: []SourceHits{}}
+	for _, source := range sources {
+		snapshot.Sources = append(snapshot.Sources, *source)
+	}
+	sortSources(snapshot.Sources)
+	return snapshot
+}
+
+// Since returns the hits of each template line since the baseline snapshot,
+// a nil baseline returns the total hits
+func (s *Snapshot) Since(baseline *Snapshot) []Hits {
+	previous := make(map[string]SourceHits)
+	var seconds float64
+	if baseline != nil {
+		for _, source := range baseline.Sources {
+			previous[source.Source()] = source
+		}
+		seconds = s.Taken.Sub(baseline.Taken).Seconds()
+	}
+
+	hits := []Hits{}
+	for _, source := range s.Sources {
+		hit := Hits{SourceHits: source}
+		if before, ok := previous[source.Source()]; ok {
+			// counters that went down were reset, count from zero
+			if source.Packets >= before.Packets && source.Bytes >= before.Bytes {
+				hit.Packets -= before.Packets
+				hit.Bytes -= before.Bytes
+			}
+		}
+		if seconds > 0 {
+			hit.PacketRate = float64(hit.Packets) / seconds
+			hit.ByteRate = float64(hit.Bytes) / seconds
+		}
+		hits = append(hits, hit)
+	}
+	return hits
+}
+
+// Merge adds the sources of another snapshot, like the other ip family
+func (s *Snapshot) Merge(other *Snapshot) {
+	for _, source := range other.Sources {
+		found := false
+		for i := range s.Sources {
+			if s.Sources[i].Source() == source.Source() {
+				s.Sources[i].Rules += source.Rules
+				s.Sources[i].Packets += source.Packets
+				s.Sources[i].Bytes += source.Bytes
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.Sources = append(s.Sources, source)
+		}
+	}
+	sortSources(s.Sources)
+}
+
+func sortSources(sources []SourceHits) {
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].File != sources[j].File {
+			return sources[i].File < sources[j].File
+		}
+		return sources[i].Line < sources[j].Line
+	})
+}
+
+// LoadSnapshot reads a snapshot saved with Save
+func LoadSnapshot(filePath string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read snapshot")
+	}
+	snapshot := new(Snapshot)
+	if err = json.Unmarshal(data, snapshot); err != nil {
+		return nil, errors.Wrapf(err, "parse snapshot '%s'", filePath)
+	}
+	return snapshot, nil
+}
+
+// Save writes the snapshot to a file
+func (s *Snapshot) Save(filePath string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "encode snapshot")
+	}
+	if err = ioutil.WriteFile(filePath+".tmp", data, 0640); err != nil {
+		return errors.Wrapf(err, "write snapshot")
+	}
+	if err = os.Rename(filePath+".tmp", filePath); err != nil {
+		return errors.Wrapf(err, "write snapshot")
+	}
+	return nil
+}
+
+// provenanceParser returns a function that finds the template file and line
+// in a comment written with the given provenance format
+func provenanceParser(format string) func(string) (string, int, bool) {
+	pattern := regexp.QuoteMeta(format)
+	fileIndex := strings.Index(pattern, `\{file\}`)
+	lineIndex := strings.Index(pattern, `\{line\}`)
+	pattern = strings.Replace(pattern, `\{file\}`, `(.+)`, 1)
+	pattern = strings.Replace(pattern, `\{line\}`, `(\d+)`, 1)
+	re := regexp.MustCompile("^" + pattern + "$")
+
+	return func(comment string) (string, int, bool) {
+		match := re.FindStringSubmatch(comment)
+		if match == nil {
+			return "", 0, false
+		}
+		file := ""
+		line := 0
+		groups := match[1:]
+		if fileIndex >= 0 && lineIndex >= 0 && lineIndex < fileIndex {
+			groups = []string{groups[1], groups[0]}
+		}
+		if fileIndex >= 0 {
+			file, groups = groups[0], groups[1:]
+		}
+		if lineIndex >= 0 {
+			line, _ = strconv.Atoi(groups[0])
+		}
+		return file, line, true
+	}
+}
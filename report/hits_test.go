@@ -0,0 +1,128 @@
+package report
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gesquive/templr/iptables"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseRules(t *testing.T, data string) *iptables.Rules {
+	rules, err := iptables.ParseRules([]byte(data), iptables.AnyFamily)
+	assert.NoError(t, err, "unexpected error")
+	return rules
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	ipv4 := parseRules(t, `*filter
+:INPUT DROP [0:0]
+[10:1000] -A INPUT -s 10.0.0.1/32 -m comment --comment "templr:rules.tmpl:4" -j ACCEPT
+[5:500] -A INPUT -s 10.0.0.2/32 -m comment --comment "templr:rules.tmpl:4" -j ACCEPT
+[7:700] -A INPUT -p tcp --dport 22 -m comment --comment "templr:common/ssh.tmpl:2" -j ACCEPT
+[3:300] -A INPUT -m comment --comment "allow ping" -p icmp -j ACCEPT
+[1:100] -A INPUT -i lo -j ACCEPT
+COMMIT
+`)
+	ipv6 := parseRules(t, `*filter
+:INPUT DROP [0:0]
+[2:200] -A INPUT -p tcp --dport 22 -m comment --comment "templr:common/ssh.tmpl:2" -j ACCEPT
+-A INPUT -p tcp --dport 80 -m comment --comment "templr:rules.tmpl:9" -j ACCEPT
+COMMIT
+`)
+
+	snapshot := TakeSnapshot([]*iptables.Rules{ipv4, nil, ipv6}, "templr:{file}:{line}")
+	assert.Equal(t, []SourceHits{
+		{File: "common/ssh.tmpl", Line: 2, Rules: 2, Packets: 9, Bytes: 900},
+		{File: "rules.tmpl", Line: 4, Rules: 2, Packets: 15, Bytes: 1500},
+		{File: "rules.tmpl", Line: 9, Rules: 1},
+	}, snapshot.Sources, "sources do not match")
+}
+
+func TestSnapshotSince(t *testing.T) {
+	taken := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	baseline := &Snapshot{Taken: taken, Sources: []SourceHits{
+		{File: "rules.tmpl", Line: 4, Rules: 1, Packets: 10, Bytes: 1000},
+		{File: "rules.tmpl", Line: 6, Rules: 1, Packets: 50, Bytes: 5000},
+	}}
+	current := &Snapshot{Taken: taken.Add(10 * time.Second), Sources: []SourceHits{
+		{File: "rules.tmpl", Line: 4, Rules: 1, Packets: 30, Bytes: 3000},
+		{File: "rules.tmpl", Line: 6, Rules: 1, Packets: 5, Bytes: 500},
+		{File: "rules.tmpl", Line: 8, Rules: 1, Packets: 1, Bytes: 100},
+	}}
+
+	hits := current.Since(baseline)
+	assert.Len(t, hits, 3, "unexpected hits")
+	assert.Equal(t, uint64(20), hits[0].Packets, "packets do not match")
+	assert.Equal(t, uint64(2000), hits[0].Bytes, "bytes do not match")
+	assert.Equal(t, 2.0, hits[0].PacketRate, "packet rate does not match")
+	assert.Equal(t, 200.0, hits[0].ByteRate, "byte rate does not match")
+	// the counters were reset
+	assert.Equal(t, uint64(5), hits[1].Packets, "packets do not match")
+	// new since the baseline
+	assert.Equal(t, uint64(1), hits[2].Packets, "packets do not match")
+
+	totals := current.Since(nil)
+	assert.Equal(t, uint64(30), totals[0].Packets, "packets do not match")
+	assert.Equal(t, 0.0, totals[0].PacketRate, "unexpected rate")
+}
+
+func TestSnapshotMerge(t *testing.T) {
+	snapshot := &Snapshot{Sources: []SourceHits{
+		{File: "rules.tmpl", Line: 4, Rules: 1, Packets: 10, Bytes: 1000},
+	}}
+	snapshot.Merge(&Snapshot{Sources: []SourceHits{
+		{File: "rules.tmpl", Line: 4, Rules: 1, Packets: 2, Bytes: 200},
+		{File: "rules.tmpl", Line: 2, Rules: 1, Packets: 1, Bytes: 100},
+	}})
+	assert.Equal(t, []SourceHits{
+		{File: "rules.tmpl", Line: 2, Rules: 1, Packets: 1, Bytes: 100},
+		{File: "rules.tmpl", Line: 4, Rules: 2, Packets: 12, Bytes: 1200},
+	}, snapshot.Sources, "sources do not match")
+}
+
+func TestSnapshotSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templr-report")
+	assert.NoError(t, err, "unexpected error")
+	defer os.RemoveAll(dir)
+
+	snapshot := &Snapshot{
+		Taken:   time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC),
+		Sources: []SourceHits{{File: "rules.tmpl", Line: 4, Rules: 1, Packets: 10, Bytes: 1000}},
+	}
+	filePath := path.Join(dir, "ipv4.hits.json")
+	assert.NoError(t, snapshot.Save(filePath), "unexpected error")
+
+	loaded, err := LoadSnapshot(filePath)
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, snapshot, loaded, "snapshot does not match")
+
+	_, err = LoadSnapshot(path.Join(dir, "missing.json"))
+	assert.Error(t, err, "expected an error")
+}
+
+func TestProvenanceParser(t *testing.T) {
+	tests := []struct {
+		format  string
+		comment string
+		file    string
+		line    int
+		ok      bool
+	}{
+		{"templr:{file}:{line}", "templr:rules.tmpl:12", "rules.tmpl", 12, true},
+		{"templr:{file}:{line}", "templr:dir/a:b.tmpl:3", "dir/a:b.tmpl", 3, true},
+		{"templr:{file}:{line}", "allow ssh", "", 0, false},
+		{"line {line} of {file}", "line 7 of rules.tmpl", "rules.tmpl", 7, true},
+		{"[{file}]", "[rules.tmpl]", "rules.tmpl", 0, true},
+		{"managed by templr", "managed by templr", "", 0, true},
+	}
+	for _, test := range tests {
+		file, line, ok := provenanceParser(test.format)(test.comment)
+		assert.Equal(t, test.ok, ok, "match does not match for %q", test.comment)
+		assert.Equal(t, test.file, file, "file does not match for %q", test.comment)
+		assert.Equal(t, test.line, line, "line does not match for %q", test.comment)
+	}
+}
@@ -0,0 +1,114 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDir is where templr keeps its state between runs
+const DefaultDir = "/var/lib/templr"
+
+// Record holds what templr remembers about the rules it applied to a single
+// ip family
+type Record struct {
+	Chains map[string][]string `json:"chains,omitempty"`
+	// Hash is the hash of the generated rules that were applied
+	Hash      string    `json:"hash,omitempty"`
+	AppliedAt time.Time `json:"applied_at"`
+	// Rules are the live rules right after the apply, without counters
+	Rules string `json:"rules,omitempty"`
+	// Specs map the rules as generated to the rules as iptables lists them
+	Specs map[string]string `json:"specs,omitempty"`
+}
+
+// Applied returns true if the record remembers an apply
+func (r *Record) Applied() bool {
+	return len(r.Hash) > 0
+}
+
+// Forget drops what the record remembers about the last apply
+func (r *Record) Forget() {
+	r.Hash = ""
+	r.AppliedAt = time.Time{}
+	r.Rules = ""
+	r.Specs = nil
+}
+
+// Load reads the named record from the state directory. A record that does
+// not exist yet is returned empty.
+func Load(dir string, name string) (*Record, error) {
+	record := new(Record)
+	data, err := ioutil.ReadFile(recordPath(dir, name))
+	if os.IsNotExist(err) {
+		return record, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read state")
+	}
+
+	if err = json.Unmarshal(data, record); err != nil {
+		return nil, errors.Wrapf(err, "parse state '%s'", recordPath(dir, name))
+	}
+	return record, nil
+}
+
+// Save writes the record to the state directory under the given name
+func (r *Record) Save(dir string, name string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "encode state")
+	}
+
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return errors.Wrapf(err, "create state dir")
+	}
+
+	// write to a temp file first so a crash never leaves a partial record
+	filePath := recordPath(dir, name)
+	if err = ioutil.WriteFile(filePath+".tmp", data, 0640); err != nil {
+		return errors.Wrapf(err, "write state")
+	}
+	if err = os.Rename(filePath+".tmp", filePath); err != nil {
+		return errors.Wrapf(err, "write state")
+	}
+	return nil
+}
+
+// panicMarker is the file that is kept in the state directory while the
+// firewall is locked down
+const panicMarker = "panic"
+
+// SetPanic records whether 'templr panic' has the firewall locked down, so
+// nothing else applies rules over the lockdown
+func SetPanic(dir string, active bool) error {
+	markerPath := path.Join(dir, panicMarker)
+	if !active {
+		if err := os.Remove(markerPath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "clear panic marker")
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return errors.Wrapf(err, "create state dir")
+	}
+	stamp := []byte(time.Now().Format(time.RFC3339) + "\n")
+	if err := ioutil.WriteFile(markerPath, stamp, 0640); err != nil {
+		return errors.Wrapf(err, "write panic marker")
+	}
+	return nil
+}
+
+// Panicked returns true while the firewall is locked down
+func Panicked(dir string) bool {
+	_, err := os.Stat(path.Join(dir, panicMarker))
+	return err == nil
+}
+
+func recordPath(dir string, name string) string {
+	return path.Join(dir, name+".json")
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMissingRecord(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(stateDir) // clean up
+
+	record, err := Load(stateDir, "ipv4")
+	assert.NoError(t, err, "unexpected error")
+	assert.Empty(t, record.Chains, "unexpected chains")
+}
+
+func TestSaveRecord(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(stateDir) // clean up
+
+	record := &Record{Chains: map[string][]string{"filter": {"INPUT", "TEMPLR-IN"}}}
+	err = record.Save(stateDir, "ipv4")
+	assert.NoError(t, err, "unexpected error")
+
+	loaded, err := Load(stateDir, "ipv4")
+	assert.NoError(t, err, "unexpected error")
+	assert.Equal(t, record, loaded, "records do not match")
+}
+
+func TestForgetApply(t *testing.T) {
+	record := &Record{
+		Chains:    map[string][]string{"filter": {"INPUT"}},
+		Hash:      "abc",
+		AppliedAt: time.Now(),
+		Rules:     "*filter\nCOMMIT\n",
+		Specs:     map[string]string{"filter INPUT -s 10.0.0.1 -j ACCEPT": "-s 10.0.0.1/32 -j ACCEPT"},
+	}
+	assert.True(t, record.Applied(), "expected an apply")
+
+	record.Forget()
+	assert.False(t, record.Applied(), "unexpected apply")
+	assert.True(t, record.AppliedAt.IsZero(), "unexpected apply time")
+	assert.Empty(t, record.Rules, "unexpected rules")
+	assert.Empty(t, record.Specs, "unexpected specs")
+	assert.NotEmpty(t, record.Chains, "chains should be kept")
+}
+
+func TestPanicMarker(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "templr-test")
+	assert.NoError(t, err, "failed to make dir")
+	defer os.RemoveAll(stateDir) // clean up
+
+	assert.False(t, Panicked(stateDir), "expected no lockdown")
+	assert.NoError(t, SetPanic(stateDir, true), "unexpected error")
+	assert.True(t, Panicked(stateDir), "expected a lockdown")
+	assert.NoError(t, SetPanic(stateDir, false), "unexpected error")
+	assert.False(t, Panicked(stateDir), "expected no lockdown")
+	assert.NoError(t, SetPanic(stateDir, false), "clearing twice should not fail")
+}